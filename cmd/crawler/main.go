@@ -2,30 +2,64 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/pflag"
 
 	"github.com/skaurus/ta-site-crawler/internal/crawler"
+	"github.com/skaurus/ta-site-crawler/internal/pidfile"
 	"github.com/skaurus/ta-site-crawler/internal/queue"
+	"github.com/skaurus/ta-site-crawler/internal/scope"
 	"github.com/skaurus/ta-site-crawler/internal/settings"
 	"github.com/skaurus/ta-site-crawler/internal/utils"
 )
 
 var (
 	runtimeSettings settings.Settings
+	pidFullPath     string
+
+	// those are not settings, but one-off actions that are done on start
+	listDeadLetters    bool
+	requeueDeadLetters bool
+	showMetadata       string
+	showURL            string
+	listDiscovered     bool
+	migrateQueueFrom   string
+)
+
+var (
+	// https://stackoverflow.com/a/48704300/320345
+	defaultContentTypes = map[string]string{
+		"text/html":              "html",
+		"text/css":               "css",
+		"application/javascript": "js",
+		"text/javascript":        "js",
+		"text/plain":             "txt",
+		"application/json":       "json",
+		"application/xml":        "xml",
+		"text/xml":               "xml",
+	}
 )
 
 const (
-	logFilename = "crawler.log"
+	logFilename      = "crawler.log"
+	pidFilename      = "crawler.pid"
+	defaultUserAgent = "ta-site-crawler/1.0"
+
+	// so that scripts can tell "stopped by a budget" from "done" and "failed"
+	exitCodeBudgetExhausted = 3
 )
 
 func init() {
@@ -37,6 +71,50 @@ func init() {
 		logToStdout  bool
 		logLevelName string
 		httpTimeout  uint16
+		userAgent    string
+		ignoreRobots bool
+		skipSitemaps bool
+
+		retryMaxAttempts uint8
+		retryBaseDelay   time.Duration
+		retryMaxDelay    time.Duration
+		retryStatuses    []int
+
+		requestsPerSecond     float64
+		maxConnectionsPerHost uint8
+		adaptiveThrottling    bool
+
+		convertLinks bool
+
+		outputFormat string
+		warcMaxSize  uint32
+
+		recrawl  bool
+		maxDepth uint16
+
+		includeRules []string
+		excludeRules []string
+		scopeFile    string
+		scopeTests   []string
+		hostPolicy   string
+		allowHosts   []string
+
+		stripParams    []string
+		sortParams     bool
+		dropFragments  bool
+		lowercasePaths bool
+		honorCanonical bool
+
+		maxPages    uint32
+		maxBytes    int64
+		maxDuration time.Duration
+
+		maxDocumentSize uint32
+		contentTypes    map[string]string
+		transcodeUTF8   bool
+		maxRedirects    uint8
+		pathNaming      string
+		queueBackend    string
 	)
 
 	pflag.StringVarP(&urlFlagValue, "url", "u", "", "valid url where to start crawling")
@@ -45,12 +123,67 @@ func init() {
 	pflag.BoolVarP(&logToStdout, "log-to-stdout", "c", false, "log to stdout instead of file")
 	pflag.StringVarP(&logLevelName, "log-level", "l", "debug", "log level (trace, debug, info, warn, error, fatal, panic)")
 	pflag.Uint16VarP(&httpTimeout, "http-timeout", "t", 5, "HTTP timeout in seconds")
+	pflag.StringVarP(&userAgent, "user-agent", "a", defaultUserAgent, "User-Agent header; its product token is also used to pick robots.txt rules")
+	pflag.BoolVar(&ignoreRobots, "ignore-robots", false, "do not honor robots.txt (only for sites you own!)")
+	pflag.BoolVar(&skipSitemaps, "skip-sitemaps", false, "do not seed the queue with urls from sitemaps")
+	pflag.Uint8Var(&retryMaxAttempts, "retry-max-attempts", 3, "how many times to try to download a document before giving up")
+	pflag.DurationVar(&retryBaseDelay, "retry-base-delay", time.Second, "delay before the first retry; it doubles with each next attempt")
+	pflag.DurationVar(&retryMaxDelay, "retry-max-delay", 5*time.Minute, "maximum delay between retries")
+	pflag.IntSliceVar(&retryStatuses, "retry-statuses", []int{429, 500, 502, 503, 504}, "HTTP status codes worth a retry")
+	pflag.Float64VarP(&requestsPerSecond, "rps", "r", 5, "maximum number of requests per second to a host (0 means no limit)")
+	pflag.Uint8Var(&maxConnectionsPerHost, "max-connections", 2, "maximum number of simultaneous connections to a host")
+	pflag.BoolVar(&adaptiveThrottling, "adaptive-throttling", true, "slow down when the site responds slower or asks to back off")
+	pflag.BoolVarP(&convertLinks, "convert-links", "k", false, "when crawling is complete, make links in the downloaded documents suitable for offline browsing")
+	pflag.StringVar(&outputFormat, "output-format", settings.OutputFormatFiles, "how to save the documents: files, warc, or both")
+	pflag.Uint32Var(&warcMaxSize, "warc-max-size", 1024, "start a new WARC file when the current one gets bigger than that many megabytes")
+	pflag.BoolVar(&recrawl, "recrawl", false, "revisit the urls of a complete crawl, and refresh the documents that have changed")
+	pflag.Uint16Var(&maxDepth, "max-depth", 0, "do not follow links more than that many hops away from the starting url (0 means no limit)")
+	pflag.StringArrayVar(&includeRules, "include", nil, "follow only the links matching this rule (prefix:..., glob:... or regex:...); can be repeated")
+	pflag.StringArrayVar(&excludeRules, "exclude", nil, "do not follow the links matching this rule (prefix:..., glob:... or regex:...); can be repeated")
+	pflag.StringVar(&scopeFile, "scope-file", "", "file with include/exclude rules, one per line")
+	pflag.StringVar(&hostPolicy, "host-policy", scope.HostPolicyWWW, "which hosts to crawl: exact (the starting one), www (the starting one with or without www.), domain (all subdomains of the registrable domain)")
+	pflag.StringSliceVar(&allowHosts, "allow-host", nil, "crawl this host too (*.example.com means all its subdomains); can be repeated")
+	pflag.StringSliceVar(&stripParams, "strip-params", []string{"utm_*", "fbclid", "gclid", "yclid", "phpsessid", "jsessionid"}, "query (and ;path) parameters to remove from urls; * matches anything; pass an empty value to keep them all")
+	pflag.BoolVar(&sortParams, "sort-params", true, "sort query parameters, so that the order does not matter")
+	pflag.BoolVar(&dropFragments, "drop-fragments", true, "remove #fragments from urls")
+	pflag.BoolVar(&lowercasePaths, "lowercase-paths", false, "lowercase url paths (for case-insensitive sites)")
+	pflag.BoolVar(&honorCanonical, "honor-canonical", true, "skip the documents that declare another url as canonical, and crawl that one instead")
+	pflag.Uint32Var(&maxPages, "max-pages", 0, "stop after downloading that many documents (0 means no limit)")
+	pflag.Int64Var(&maxBytes, "max-bytes", 0, "stop after downloading that many bytes (0 means no limit)")
+	pflag.DurationVar(&maxDuration, "max-duration", 0, "stop after crawling for that long, resumes included (0 means no limit)")
+	pflag.Uint32Var(&maxDocumentSize, "max-document-size", 100, "skip documents bigger than that many megabytes, and truncate the ones that turn out bigger while downloading")
+	pflag.StringToStringVar(&contentTypes, "accept-types", defaultContentTypes, "content-types of the documents to save, with file extensions for them (type=ext,...); replaces the default list")
+	pflag.BoolVar(&transcodeUTF8, "transcode-utf8", false, "store HTML and CSS documents converted to UTF-8 (WARC records are kept as is)")
+	pflag.Uint8Var(&maxRedirects, "max-redirects", 10, "how many redirects to follow for a single request (0 means redirects are not followed)")
+	pflag.StringVar(&pathNaming, "path-naming", utils.DefaultPathNaming(), fmt.Sprintf("how to name the downloaded files: %s, or %s (to copy them to Windows); must be the same on resume", utils.PathNamingPOSIX, utils.PathNamingWindowsSafe))
+	pflag.StringVar(&queueBackend, "queue-backend", queue.BackendNutsDB, fmt.Sprintf("where to keep the queue: %s (%s does not survive the restart); must be the same on resume", strings.Join(queue.Backends(), ", "), queue.BackendMemory))
+	pflag.StringArrayVar(&scopeTests, "scope-test", nil, "show if a given url is in scope and which rule decided that, and exit; can be repeated")
+	pflag.BoolVar(&listDeadLetters, "list-dead-letters", false, "list the urls we gave up on, and exit")
+	pflag.BoolVar(&requeueDeadLetters, "requeue-dead-letters", false, "put the urls we gave up on back to the queue before crawling")
+
+	pflag.BoolVar(&listDiscovered, "list-discovered", false, "list the urls found too deep to follow (see --max-depth), and exit")
+	pflag.StringVar(&showMetadata, "show-metadata", "", "print what we know about how a given url was fetched, and exit")
+	pflag.StringVar(&migrateQueueFrom, "migrate-queue-from", "", "copy the queue from a given backend to the one set by --queue-backend, and exit")
+	pflag.StringVar(&showURL, "show-url", "", "print the url a given downloaded file (relative to the crawling dir) belongs to, and exit")
 
 	pflag.Parse()
 
 	if len(urlFlagValue) == 0 {
 		reportFlagsError("--url/-u flag is required")
 	}
+	// must be done before the first url normalization
+	utils.SetCanonicalization(utils.Canonicalization{
+		StripParams:    slices.DeleteFunc(stripParams, func(param string) bool { return len(strings.TrimSpace(param)) == 0 }),
+		SortParams:     sortParams,
+		DropFragments:  dropFragments,
+		LowercasePaths: lowercasePaths,
+	})
+	// and that before the first path is made
+	if pathNaming != utils.PathNamingPOSIX && pathNaming != utils.PathNamingWindowsSafe {
+		reportFlagsError(fmt.Sprintf("--path-naming flag value must be %s or %s", utils.PathNamingPOSIX, utils.PathNamingWindowsSafe))
+	}
+	utils.SetPathNaming(pathNaming)
+
 	var err error
 	urlObject, err = url.Parse(urlFlagValue)
 	if err != nil {
@@ -64,6 +197,38 @@ func init() {
 		panic(fmt.Sprintf("can't parse normalized version of url %s: %v", urlFlagValue, err))
 	}
 
+	var scopeRules []scope.Rule
+	if len(scopeFile) > 0 {
+		scopeRules, err = scope.LoadRules(scopeFile)
+		if err != nil {
+			reportFlagsError(fmt.Sprintf("--scope-file flag value must be a valid rules file: %v", err))
+		}
+	}
+	for _, spec := range includeRules {
+		rule, err := scope.ParseRule(true, spec)
+		if err != nil {
+			reportFlagsError(fmt.Sprintf("--include flag value is invalid: %v", err))
+		}
+		scopeRules = append(scopeRules, rule)
+	}
+	for _, spec := range excludeRules {
+		rule, err := scope.ParseRule(false, spec)
+		if err != nil {
+			reportFlagsError(fmt.Sprintf("--exclude flag value is invalid: %v", err))
+		}
+		scopeRules = append(scopeRules, rule)
+	}
+	scopeFilter := scope.NewFilter(scopeRules)
+	hostPolicyObject, err := scope.NewHostPolicy(hostPolicy, urlObject, allowHosts)
+	if err != nil {
+		reportFlagsError(fmt.Sprintf("--host-policy or --allow-host flag value is invalid: %v", err))
+	}
+	// a dry run does not need anything else, so it goes before the other checks
+	if len(scopeTests) > 0 {
+		testScope(urlObject, hostPolicyObject, scopeFilter, scopeTests)
+		os.Exit(0)
+	}
+
 	if len(outputDir) == 0 {
 		reportFlagsError("--output-dir/-d flag is required")
 	}
@@ -76,13 +241,62 @@ func init() {
 		panic(fmt.Sprintf("can't get absolute path for %s", outputDir))
 	}
 
+	if retryMaxAttempts == 0 {
+		reportFlagsError("--retry-max-attempts flag value must be at least 1")
+	}
+	if retryBaseDelay < 0 || retryMaxDelay < retryBaseDelay {
+		reportFlagsError("--retry-base-delay flag value must not be negative, and not bigger than --retry-max-delay")
+	}
+
+	if maxBytes < 0 || maxDuration < 0 {
+		reportFlagsError("--max-bytes and --max-duration flag values must not be negative")
+	}
+
+	if requestsPerSecond < 0 {
+		reportFlagsError("--rps/-r flag value must not be negative")
+	}
+	if maxConnectionsPerHost == 0 {
+		reportFlagsError("--max-connections flag value must be at least 1")
+	}
+
+	switch outputFormat {
+	case settings.OutputFormatFiles, settings.OutputFormatWARC, settings.OutputFormatBoth:
+	default:
+		reportFlagsError("--output-format flag value must be one of files, warc, both")
+	}
+	contentTypes, err = parseContentTypes(contentTypes)
+	if err != nil {
+		reportFlagsError(fmt.Sprintf("--accept-types flag value is invalid: %v", err))
+	}
+
+	if maxDocumentSize == 0 {
+		reportFlagsError("--max-document-size flag value must be at least 1")
+	}
+	if warcMaxSize == 0 {
+		reportFlagsError("--warc-max-size flag value must be at least 1")
+	}
+	if convertLinks && outputFormat == settings.OutputFormatWARC {
+		reportFlagsError("--convert-links/-k flag makes no sense with --output-format=warc")
+	}
+
+	if !slices.Contains(queue.Backends(), queueBackend) {
+		reportFlagsError(fmt.Sprintf("--queue-backend flag value must be one of %s", strings.Join(queue.Backends(), ", ")))
+	}
+	if len(migrateQueueFrom) > 0 && !slices.Contains(queue.Backends(), migrateQueueFrom) {
+		reportFlagsError(fmt.Sprintf("--migrate-queue-from flag value must be one of %s", strings.Join(queue.Backends(), ", ")))
+	}
+
+	if len(strings.TrimSpace(userAgent)) == 0 {
+		reportFlagsError("--user-agent/-a flag value must not be empty")
+	}
+
 	logLevel, err := zerolog.ParseLevel(logLevelName)
 	if err != nil {
 		reportFlagsError("--log-level/-l flag value must be one of trace, debug, info, warn, error, fatal, panic")
 	}
 
 	subfolder := utils.DomainToOutputFolder(urlObject)
-	outputDir = outputDir + "/" + subfolder
+	outputDir = filepath.Join(outputDir, subfolder)
 
 	err = os.Mkdir(outputDir, settings.DirPermissions)
 	if err != nil && !os.IsExist(err) {
@@ -96,7 +310,7 @@ func init() {
 	if logToStdout {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
 	} else {
-		logFullPath := outputDir + "/" + logFilename
+		logFullPath := filepath.Join(outputDir, logFilename)
 		logFile, err := os.OpenFile(logFullPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, settings.FilePermissions)
 		if err != nil {
 			panic(fmt.Sprintf("can't create logfile %s: %v", logFullPath, err))
@@ -105,11 +319,82 @@ func init() {
 	}
 	fmt.Printf("logfile is %s inside output dir\n", logFilename)
 
-	runtimeSettings = settings.Save(urlObject, outputDir, workersCnt, &log.Logger, httpTimeout)
+	// two instances working with the same folder would corrupt the queue (and
+	// the crawled files), see MADR 003
+	pidFullPath = filepath.Join(outputDir, pidFilename)
+	err = pidfile.Acquire(pidFullPath)
+	if err != nil {
+		log.Logger.Error().Err(err).Msg("can't acquire pid file")
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	runtimeSettings = settings.Save(settings.Params{
+		URL:          urlObject,
+		OutputDir:    outputDir,
+		WorkersCnt:   workersCnt,
+		Logger:       &log.Logger,
+		HTTPTimeout:  httpTimeout,
+		UserAgent:    userAgent,
+		IgnoreRobots: ignoreRobots,
+		SkipSitemaps: skipSitemaps,
+
+		RetryMaxAttempts: retryMaxAttempts,
+		RetryBaseDelay:   retryBaseDelay,
+		RetryMaxDelay:    retryMaxDelay,
+		RetryStatuses:    retryStatuses,
+
+		RequestsPerSecond:     requestsPerSecond,
+		MaxConnectionsPerHost: maxConnectionsPerHost,
+		AdaptiveThrottling:    adaptiveThrottling,
+
+		ConvertLinks: convertLinks,
+		OutputFormat: outputFormat,
+		WARCMaxSize:  int64(warcMaxSize) * 1024 * 1024,
+
+		Recrawl:    recrawl,
+		MaxDepth:   maxDepth,
+		Scope:      scopeFilter,
+		HostPolicy: hostPolicyObject,
+
+		HonorCanonical: honorCanonical,
+
+		MaxPages:    maxPages,
+		MaxBytes:    maxBytes,
+		MaxDuration: maxDuration,
+
+		MaxDocumentSize: int64(maxDocumentSize) * 1024 * 1024,
+		ContentTypes:    contentTypes,
+		TranscodeUTF8:   transcodeUTF8,
+		MaxRedirects:    maxRedirects,
+		QueueBackend:    queueBackend,
+	})
 }
 
 func main() {
+	// os.Exit does not run deferred functions, so all the work is done in run
+	os.Exit(run())
+}
+
+// run returns the exit code
+func run() int {
 	logger := runtimeSettings.Logger()
+	// deferred first to be run last, after the queue is closed
+	defer releasePidFile()
+
+	// the migration is done before the queue is opened, because the target
+	// store must be empty, and queue.Init would put the starting url there
+	if len(migrateQueueFrom) > 0 {
+		report, err := queue.Migrate(migrateQueueFrom, runtimeSettings.QueueBackend(), runtimeSettings.OutputDir())
+		if err != nil {
+			fmt.Printf("can't migrate queue: %v\n", err)
+			logger.Error().Err(err).Msg("can't migrate queue")
+			return 1
+		}
+		fmt.Printf("queue is migrated from %s to %s: %d pending, %d in progress, %d processed, %d entries total\n", migrateQueueFrom, runtimeSettings.QueueBackend(), report.Pending, report.InProgress, report.Processed, report.Entries)
+		logger.Info().Str("from", migrateQueueFrom).Str("to", runtimeSettings.QueueBackend()).Any("report", report).Msg("queue is migrated")
+		return 0
+	}
 
 	// this method tries to open already existing queue, or if it does not exist —
 	// creates a new one and populates it with provided starting URL
@@ -124,10 +409,63 @@ func main() {
 		}
 	}()
 
-	err = crawler.Init()
+	if listDeadLetters {
+		deadLetters, err := q.DeadLetters()
+		if err != nil {
+			panic(fmt.Sprintf("can't list dead letters: %v", err))
+		}
+		for _, deadLetter := range deadLetters {
+			fmt.Printf("%s\t%s\tattempts: %d\t%s\n", deadLetter.At.Format(time.RFC3339), deadLetter.URL, deadLetter.Attempts, deadLetter.Reason)
+		}
+		fmt.Printf("%d dead letters\n", len(deadLetters))
+		return 0
+	}
+	if listDiscovered {
+		discovered, err := q.Discovered()
+		if err != nil {
+			panic(fmt.Sprintf("can't list discovered urls: %v", err))
+		}
+		for _, task := range discovered {
+			fmt.Printf("%s\tdepth: %d\treferrer: %s\n", task.URL, task.Depth, task.Referrer)
+		}
+		fmt.Printf("%d discovered urls\n", len(discovered))
+		return 0
+	}
+	if len(showMetadata) > 0 {
+		printMetadata(q, showMetadata)
+		return 0
+	}
+	if len(showURL) > 0 {
+		owner, found, err := q.PathOwner(utils.PathKey(filepath.ToSlash(filepath.Clean(showURL))))
+		if err != nil {
+			panic(fmt.Sprintf("can't get path owner: %v", err))
+		}
+		if !found {
+			fmt.Printf("%s is not a file we have downloaded\n", showURL)
+			return 0
+		}
+		fmt.Println(owner)
+		return 0
+	}
+	if requeueDeadLetters {
+		requeued, err := q.RequeueDeadLetters()
+		if err != nil {
+			panic(fmt.Sprintf("can't requeue dead letters: %v", err))
+		}
+		fmt.Printf("%d dead letters are requeued\n", requeued)
+		logger.Info().Int("requeued", requeued).Msg("dead letters are requeued")
+	}
+
+	err = crawler.Init(q)
 	if err != nil {
 		panic(fmt.Sprintf("can't initialize crawler: %v", err))
 	}
+	defer func() {
+		err := crawler.Cleanup()
+		if err != nil {
+			logger.Error().Err(err).Msg("can't cleanup crawler")
+		}
+	}()
 
 	// facility to gracefully interrupt the program execution
 	sigCh := make(chan os.Signal, 1)
@@ -135,6 +473,34 @@ func main() {
 	// production system would also catch SIGHUP to reopen the logfile to allow for logrotate
 
 	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		sig := <-sigCh
+		logger.Warn().Any("sig", sig).Msg("got signal, exiting...")
+		cancel()
+		// in-flight tasks can take a while to finish; if someone is impatient
+		// enough to send the second signal, we exit right away. queue is not
+		// closed properly in this case, but the leases make that survivable
+		sig = <-sigCh
+		logger.Warn().Any("sig", sig).Msg("got second signal, exiting immediately")
+		releasePidFile()
+		os.Exit(1)
+	}()
+
+	// sitemaps are processed before workers start, so that workers do not
+	// decide there is nothing to do while we are still reading them.
+	// big sites can have a lot of sitemaps, so it makes sense to allow
+	// interrupting that too, hence ctx
+	if !runtimeSettings.SkipSitemaps() {
+		err = crawler.DiscoverSitemaps(ctx, q)
+		if ctx.Err() != nil {
+			logger.Warn().Msg("exited")
+			return 0
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("sitemaps discovery failed")
+		}
+	}
 	wg := sync.WaitGroup{}
 	wg.Add(int(runtimeSettings.WorkersCnt()))
 	// this method starts requested number of goroutines
@@ -149,19 +515,6 @@ func main() {
 	// Use a channel to signal when workers are done.
 	exitCh := make(chan struct{})
 
-	go func() {
-	forLoop:
-		for { //nolint:gosimple
-			select {
-			case sig := <-sigCh:
-				logger.Warn().Any("sig", sig).Msg("got signal, exiting...")
-				cancel()
-				break forLoop
-			}
-		}
-		close(sigCh)
-	}()
-
 	// wait for all workers to finish and signal to close exitCh
 	go func() {
 		wg.Wait()     // Wait for all workers to finish.
@@ -171,7 +524,101 @@ func main() {
 	// block until exitCh is closed
 	<-exitCh
 
+	// workers stop either when there is nothing left to do, when we were
+	// asked to stop, or when a crawl budget is exhausted; in the latter two
+	// cases the crawling is not complete yet
+	exhaustedBudget := crawler.ExhaustedBudget()
+	if runtimeSettings.ConvertLinks() && ctx.Err() == nil && len(exhaustedBudget) == 0 {
+		err = crawler.ConvertLinks(q)
+		if err != nil {
+			logger.Error().Err(err).Msg("can't convert links")
+		}
+	}
+
+	if runtimeSettings.Recrawl() {
+		report := crawler.GetRecrawlReport()
+		fmt.Printf("recrawl: %d changed, %d unchanged, %d disappeared, %d new\n", report.Changed, report.Unchanged, report.Disappeared, report.New)
+		logger.Info().Uint32("changed", report.Changed).Uint32("unchanged", report.Unchanged).Uint32("disappeared", report.Disappeared).Uint32("new", report.New).Msg("recrawl report")
+	}
+
+	if len(exhaustedBudget) > 0 {
+		fmt.Printf("crawl budget is exhausted: %s\n", exhaustedBudget)
+		logger.Warn().Str("budget", exhaustedBudget).Msg("exited, crawl budget is exhausted")
+		return exitCodeBudgetExhausted
+	}
+
 	logger.Warn().Msg("exited")
+	return 0
+}
+
+func printMetadata(q queue.Queue, urlString string) {
+	// urls are stored normalized
+	if urlObject, err := url.Parse(urlString); err == nil {
+		if urlObject, err = utils.NormalizeUrlObject(urlObject); err == nil {
+			urlString = urlObject.String()
+		}
+	}
+	metadata, found, err := q.Metadata(urlString)
+	if err != nil {
+		panic(fmt.Sprintf("can't get metadata: %v", err))
+	}
+	if !found {
+		fmt.Printf("there is no metadata for %s\n", urlString)
+		return
+	}
+	encoded, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		panic(fmt.Sprintf("can't encode metadata: %v", err))
+	}
+	fmt.Println(string(encoded))
+}
+
+// testScope prints what the crawler would think of the given urls, if it found
+// links to them
+func testScope(startUrlObject *url.URL, hostPolicy *scope.HostPolicy, scopeFilter *scope.Filter, urlStrings []string) {
+	for _, urlString := range urlStrings {
+		urlObject, err := url.Parse(urlString)
+		if err != nil {
+			fmt.Printf("%s\tinvalid url: %v\n", urlString, err)
+			continue
+		}
+		// relative urls are resolved the same way as links on the start page
+		urlObject, err = utils.NormalizeUrlObject(startUrlObject.ResolveReference(urlObject))
+		if err != nil {
+			fmt.Printf("%s\tinvalid url: %v\n", urlString, err)
+			continue
+		}
+		if !hostPolicy.Allows(urlObject) {
+			fmt.Printf("%s\tout of scope, host is not allowed by the host policy\n", urlObject)
+			continue
+		}
+		fmt.Printf("%s\t%s\n", urlObject, scopeFilter.Check(urlObject))
+	}
+}
+
+// parseContentTypes normalizes the content-type -> extension mapping
+func parseContentTypes(raw map[string]string) (map[string]string, error) {
+	contentTypes := make(map[string]string, len(raw))
+	for contentType, ext := range raw {
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+		ext = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")
+		if !strings.Contains(contentType, "/") || len(ext) == 0 || strings.ContainsAny(ext, "./\\") {
+			return nil, fmt.Errorf("%q=%q is not a content-type and a file extension", contentType, ext)
+		}
+		contentTypes[contentType] = ext
+	}
+	if len(contentTypes) == 0 {
+		return nil, fmt.Errorf("no content-types are accepted")
+	}
+
+	return contentTypes, nil
+}
+
+func releasePidFile() {
+	err := pidfile.Release(pidFullPath)
+	if err != nil {
+		runtimeSettings.Logger().Error().Err(err).Msg("can't remove pid file")
+	}
 }
 
 func reportFlagsError(errText string) {
@@ -7,8 +7,10 @@ require (
 	github.com/nutsdb/nutsdb v0.14.1
 	github.com/rs/zerolog v1.30.0
 	github.com/spf13/pflag v1.0.5
+	go.etcd.io/bbolt v1.3.8
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9
 	golang.org/x/net v0.0.0-20220617184016-355a448f1bc9
+	golang.org/x/text v0.3.7
 )
 
 require (
@@ -24,5 +26,4 @@ require (
 	github.com/xujiajun/mmap-go v1.0.1 // indirect
 	github.com/xujiajun/utils v0.0.0-20220904132955-5f7c5b914235 // indirect
 	golang.org/x/sys v0.12.0 // indirect
-	golang.org/x/text v0.3.7 // indirect
 )
@@ -0,0 +1,77 @@
+package crawler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+// documents are not read to memory as a whole: the body is streamed to a temp
+// file, and only HTML and CSS are also kept in memory (up to a limit), because
+// we parse them for links
+
+const (
+	// links are extracted only from that many first bytes of a document
+	maxParsedSize = 10 * 1024 * 1024
+)
+
+// boundedBuffer keeps only the first limit bytes written to it, and silently
+// drops the rest (io.MultiWriter would stop on an error)
+type boundedBuffer struct {
+	bytes.Buffer
+	limit      int
+	overflowed bool
+}
+
+func (bb *boundedBuffer) Write(p []byte) (int, error) {
+	if room := bb.limit - bb.Len(); room < len(p) {
+		bb.overflowed = true
+		if room > 0 {
+			bb.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return bb.Buffer.Write(p)
+}
+
+type streamedBody struct {
+	size int64
+	// sha256 of the body, hex-encoded
+	digest string
+	// the body was bigger than maxSize, and we have read only maxSize bytes
+	truncated bool
+	// the body, or its beginning; nil unless it was asked for
+	parsed          []byte
+	parsedPartially bool
+}
+
+// streamBody copies no more than maxSize bytes of the body to dst; if keep is
+// true, the beginning of the body is kept for parsing too
+func streamBody(dst io.Writer, src io.Reader, maxSize int64, keep bool) (result streamedBody, err error) {
+	hasher := sha256.New()
+	writers := []io.Writer{dst, hasher}
+	var buffer *boundedBuffer
+	if keep {
+		buffer = &boundedBuffer{limit: maxParsedSize}
+		writers = append(writers, buffer)
+	}
+
+	result.size, err = io.Copy(io.MultiWriter(writers...), io.LimitReader(src, maxSize))
+	if err != nil {
+		return result, err
+	}
+	result.digest = hex.EncodeToString(hasher.Sum(nil))
+	// LimitReader says nothing about whether there was more
+	if result.size == maxSize {
+		var oneMore [1]byte
+		if n, _ := io.ReadFull(src, oneMore[:]); n > 0 {
+			result.truncated = true
+		}
+	}
+	if buffer != nil {
+		result.parsed, result.parsedPartially = buffer.Bytes(), buffer.overflowed
+	}
+
+	return result, nil
+}
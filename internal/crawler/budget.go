@@ -0,0 +1,106 @@
+package crawler
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skaurus/ta-site-crawler/internal/queue"
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+// crawl budgets: --max-pages, --max-bytes and --max-duration. when any of them
+// is exhausted, workers stop taking new tasks, and the ones in flight are
+// finished — so the limits can be overshot by a few documents.
+// the usage is saved to the queue, so the budgets survive resume; a new
+// --recrawl pass starts over.
+
+const (
+	BudgetPages    = "pages"
+	BudgetBytes    = "bytes"
+	BudgetDuration = "duration"
+)
+
+var (
+	budgetQueue queue.Queue
+	// usage of the previous runs is loaded on start
+	usedPages     int64
+	usedBytes     int64
+	elapsedBefore time.Duration
+	runStartedAt  time.Time
+
+	exhaustedBudgetOnce sync.Once
+	exhaustedBudget     atomic.Value
+)
+
+func initBudget(q queue.Queue) error {
+	usage, err := q.Usage()
+	if err != nil {
+		return err
+	}
+	budgetQueue = q
+	atomic.StoreInt64(&usedPages, usage.Pages)
+	atomic.StoreInt64(&usedBytes, usage.Bytes)
+	elapsedBefore, runStartedAt = usage.Elapsed, time.Now()
+
+	return nil
+}
+
+func elapsed() time.Duration {
+	return elapsedBefore + time.Since(runStartedAt)
+}
+
+// recordUsage counts a downloaded document
+func recordUsage(bytes int64) error {
+	usage, err := budgetQueue.AddUsage(1, bytes, elapsed())
+	if err != nil {
+		// let's still count it, at least for this run
+		atomic.AddInt64(&usedPages, 1)
+		atomic.AddInt64(&usedBytes, bytes)
+		return err
+	}
+	atomic.StoreInt64(&usedPages, usage.Pages)
+	atomic.StoreInt64(&usedBytes, usage.Bytes)
+
+	return nil
+}
+
+// saveElapsed saves the time spent crawling in this run
+func saveElapsed() error {
+	if budgetQueue == nil {
+		return nil
+	}
+	_, err := budgetQueue.AddUsage(0, 0, elapsed())
+	return err
+}
+
+// checkBudget returns the name of the exhausted budget, if any
+func checkBudget() string {
+	runtimeSettings := settings.Get()
+
+	var exhausted string
+	switch {
+	case runtimeSettings.MaxPages() > 0 && atomic.LoadInt64(&usedPages) >= int64(runtimeSettings.MaxPages()):
+		exhausted = BudgetPages
+	case runtimeSettings.MaxBytes() > 0 && atomic.LoadInt64(&usedBytes) >= runtimeSettings.MaxBytes():
+		exhausted = BudgetBytes
+	case runtimeSettings.MaxDuration() > 0 && elapsed() >= runtimeSettings.MaxDuration():
+		exhausted = BudgetDuration
+	default:
+		return ""
+	}
+
+	exhaustedBudgetOnce.Do(func() {
+		exhaustedBudget.Store(exhausted)
+		runtimeSettings.Logger().Warn().Str("budget", exhausted).Int64("pages", atomic.LoadInt64(&usedPages)).Int64("bytes", atomic.LoadInt64(&usedBytes)).Dur("elapsed", elapsed()).Msg("crawl budget is exhausted, stopping")
+	})
+
+	return exhausted
+}
+
+// ExhaustedBudget returns the name of the budget that stopped the crawl; it
+// is empty if the crawl was not stopped by a budget
+func ExhaustedBudget() string {
+	exhausted, _ := exhaustedBudget.Load().(string)
+	return exhausted
+}
@@ -0,0 +1,174 @@
+package crawler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"regexp"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// documents come in all sorts of encodings, and html.Parse (as well as our
+// CSS regexps) expects UTF-8. so we find out the encoding the way browsers
+// do, and decode the documents before looking for links in them.
+// the stored documents are left as they were, unless --transcode-utf8 is given.
+
+// the charset declaration must be in the first 1024 bytes for HTML, and at the
+// very start for CSS; we look a bit further, just in case
+const charsetDeclarationLength = 64 * 1024
+
+var (
+	cssCharsetRe = regexp.MustCompile(`^@charset\s+["']([^"']*)["']`)
+	// both <meta charset="..."> and <meta http-equiv="Content-Type" content="text/html; charset=...">
+	htmlMetaCharsetRe = regexp.MustCompile(`(?is)(<meta\b[^>]*?\bcharset\s*=\s*["']?)([-\w.:]+)`)
+	htmlHeadRe        = regexp.MustCompile(`(?is)<head\b[^>]*>`)
+	utf8BOM           = []byte("\xef\xbb\xbf")
+)
+
+// documentEncoding determines the encoding of an HTML or CSS document from
+// the BOM, the Content-Type header and the document itself. name is the
+// canonical name of the encoding, like "windows-1251"
+func documentEncoding(content []byte, contentType, header string) (e encoding.Encoding, name string) {
+	if contentType == "text/css" {
+		return cssEncoding(content, header)
+	}
+
+	e, name, certain := charset.DetermineEncoding(content, header)
+	// when nothing is declared, DetermineEncoding looks at the first 1024 bytes
+	// only, and falls back to windows-1252 if those are plain ASCII. but a page
+	// that is valid UTF-8 as a whole is most likely just that
+	if !certain && name == "windows-1252" && utf8.Valid(content) {
+		return encoding.Nop, "utf-8"
+	}
+
+	return e, name
+}
+
+// cssEncoding follows https://www.w3.org/TR/css-syntax-3/#input-byte-stream,
+// except that we do not know the encoding of the referring document
+func cssEncoding(content []byte, header string) (encoding.Encoding, string) {
+	if bytes.HasPrefix(content, utf8BOM) {
+		return encoding.Nop, "utf-8"
+	}
+	// UTF-16 BOMs
+	if bytes.HasPrefix(content, []byte("\xfe\xff")) {
+		return charset.Lookup("utf-16be")
+	}
+	if bytes.HasPrefix(content, []byte("\xff\xfe")) {
+		return charset.Lookup("utf-16le")
+	}
+	if _, params, err := mime.ParseMediaType(header); err == nil {
+		if e, name := charset.Lookup(params["charset"]); e != nil {
+			return e, name
+		}
+	}
+	if groups := cssCharsetRe.FindSubmatch(content); groups != nil {
+		if e, name := charset.Lookup(string(groups[1])); e != nil {
+			// the spec says so: a stylesheet can't be UTF-16 and declare it in ASCII
+			if name == "utf-16be" || name == "utf-16le" {
+				return encoding.Nop, "utf-8"
+			}
+			return e, name
+		}
+	}
+
+	return encoding.Nop, "utf-8"
+}
+
+func isUTF8(name string) bool {
+	return name == "utf-8"
+}
+
+// decodeDocument returns the content converted to UTF-8
+func decodeDocument(content []byte, e encoding.Encoding) ([]byte, error) {
+	decoded, err := e.NewDecoder().Bytes(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimPrefix(decoded, utf8BOM), nil
+}
+
+// encodeDocument converts the UTF-8 content of an HTML or CSS document back to
+// the given encoding. the characters the encoding does not have are escaped:
+// as numeric references (&#20013;) in HTML, and as \4e2d in CSS
+func encodeDocument(content []byte, e encoding.Encoding, contentType string) ([]byte, error) {
+	if contentType == "text/html" {
+		return encoding.HTMLEscapeUnsupported(e.NewEncoder()).Bytes(content)
+	}
+
+	// the encodings from charset.Lookup escape what they do not have as HTML
+	// references, and the others fail on it; neither is any good for CSS, so
+	// we check that the content survives the round trip
+	encoder, decoder := e.NewEncoder(), e.NewDecoder()
+	encoded, err := encoder.Bytes(content)
+	if err == nil {
+		if decoded, err := decoder.Bytes(encoded); err == nil && bytes.Equal(decoded, content) {
+			return encoded, nil
+		}
+	}
+	// that is rare, so it is fine to go character by character then. the
+	// space ends the escape, and is eaten by the CSS parser
+	var buf bytes.Buffer
+	for _, r := range string(content) {
+		char := string(r)
+		if encoded, err := encoder.Bytes([]byte(char)); err == nil {
+			if decoded, err := decoder.Bytes(encoded); err == nil && string(decoded) == char {
+				buf.Write(encoded)
+				continue
+			}
+		}
+		fmt.Fprintf(&buf, "\\%x ", r)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// transcodeDocument writes the document from src to dst in UTF-8, and makes
+// its charset declaration say so
+func transcodeDocument(dst io.Writer, src io.ReadSeeker, e encoding.Encoding, contentType string) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	decoded := transform.NewReader(src, e.NewDecoder())
+
+	head := make([]byte, charsetDeclarationLength)
+	n, err := io.ReadFull(decoded, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	head = fixCharsetDeclaration(bytes.TrimPrefix(head[:n], utf8BOM), contentType)
+	if _, err := dst.Write(head); err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, decoded)
+
+	return err
+}
+
+// fixCharsetDeclaration makes the beginning of an HTML or CSS document
+// declare UTF-8. HTML without a declaration gets one, so the browser does not
+// have to guess when the file is opened locally
+func fixCharsetDeclaration(head []byte, contentType string) []byte {
+	switch contentType {
+	case "text/css":
+		return cssCharsetRe.ReplaceAll(head, []byte(`@charset "utf-8"`))
+	case "text/html":
+		if htmlMetaCharsetRe.Match(head) {
+			return htmlMetaCharsetRe.ReplaceAll(head, []byte("${1}utf-8"))
+		}
+		if loc := htmlHeadRe.FindIndex(head); loc != nil {
+			fixed := make([]byte, 0, len(head)+len(`<meta charset="utf-8">`))
+			fixed = append(fixed, head[:loc[1]]...)
+			fixed = append(fixed, `<meta charset="utf-8">`...)
+			return append(fixed, head[loc[1]:]...)
+		}
+	}
+
+	return head
+}
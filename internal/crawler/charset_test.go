@@ -0,0 +1,33 @@
+package crawler
+
+import (
+	"testing"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+)
+
+func TestEncodeDocument(t *testing.T) {
+	lookedUp, _ := charset.Lookup("windows-1251")
+	for _, test := range []struct {
+		name        string
+		e           encoding.Encoding
+		contentType string
+		expected    string
+	}{
+		{"html", charmap.Windows1251, "text/html", "\xef\xf0\xe8\xe2\xe5\xf2 &#20013;"},
+		{"css", charmap.Windows1251, "text/css", "\xef\xf0\xe8\xe2\xe5\xf2 \\4e2d "},
+		// the encodings from charset.Lookup escape for HTML on their own
+		{"css, looked up", lookedUp, "text/css", "\xef\xf0\xe8\xe2\xe5\xf2 \\4e2d "},
+	} {
+		encoded, err := encodeDocument([]byte("привет 中"), test.e, test.contentType)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(encoded) != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, encoded, test.expected)
+		}
+	}
+}
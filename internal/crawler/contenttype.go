@@ -0,0 +1,82 @@
+package crawler
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+// servers do not always tell the truth about content-type: some send
+// application/octet-stream for everything they are not configured for, and
+// some do not send the header at all. in those cases we make a guess
+
+// http.DetectContentType never looks further than that
+const sniffLength = 512
+
+var (
+	// those tell nothing about the content
+	genericContentTypes = map[string]struct{}{
+		"":                         {},
+		"application/octet-stream": {},
+		"binary/octet-stream":      {},
+		"application/unknown":      {},
+		"application/x-unknown":    {},
+		"unknown/unknown":          {},
+	}
+)
+
+// mediaType returns the media type from a Content-Type header value
+func mediaType(contentType string) string {
+	// now, content-type will likely be something like "text/html; charset=utf-8",
+	// and we are interested in just "text/html". also, I'm pretty sure in the wild
+	// big Internet it can be something like "text/html ;charset = utf-8" and browsers
+	// will still work. maybe it could be even worse
+	contentTypeParts := strings.Split(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(contentTypeParts[0]))
+}
+
+func isGenericContentType(contentType string) bool {
+	_, ok := genericContentTypes[contentType]
+	return ok
+}
+
+// extensionContentType returns an accepted content-type for the extension of
+// the URL path, if there is one
+func extensionContentType(urlObject *url.URL) string {
+	ext := strings.TrimPrefix(strings.ToLower(path.Ext(urlObject.Path)), ".")
+	if len(ext) == 0 {
+		return ""
+	}
+
+	var candidates []string
+	for contentType, contentTypeExt := range settings.Get().ContentTypes() {
+		if contentTypeExt == ext {
+			candidates = append(candidates, contentType)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	// map order is random, and we want the same answer every time
+	slices.Sort(candidates)
+
+	return candidates[0]
+}
+
+// sniffContentType guesses the content-type from the URL extension and the
+// beginning of the body. The extension wins, unless the body looks binary.
+func sniffContentType(urlObject *url.URL, head []byte) string {
+	sniffed := mediaType(http.DetectContentType(head))
+	_, sniffedIsAccepted := settings.Get().ContentTypes()[sniffed]
+	looksTextual := strings.HasPrefix(sniffed, "text/") || sniffedIsAccepted
+
+	if byExtension := extensionContentType(urlObject); len(byExtension) > 0 && looksTextual {
+		return byExtension
+	}
+
+	return sniffed
+}
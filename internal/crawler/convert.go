@@ -0,0 +1,265 @@
+package crawler
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+
+	"github.com/skaurus/ta-site-crawler/internal/queue"
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+	"github.com/skaurus/ta-site-crawler/internal/utils"
+)
+
+// links conversion for offline browsing, like `wget --convert-links` does:
+// links to the documents we have downloaded become relative links to the
+// local files, and all the other links become absolute, so they still work.
+// it is done once the crawling is complete, because only then we know the
+// final names of all the files (extensions are added based on content-type).
+
+type linkConverter struct {
+	localFiles map[string]queue.Metadata
+	// set of local file paths, to recognize links that are already converted
+	localPaths map[string]struct{}
+}
+
+// ConvertLinks rewrites the links in all the downloaded HTML and CSS documents
+func ConvertLinks(q queue.Queue) error {
+	logger := settings.Get().Logger().With().Str("stage", "convert-links").Logger()
+	crawlingDir := filepath.Join(settings.Get().OutputDir(), settings.CrawlingDir)
+
+	all, err := q.AllMetadata()
+	if err != nil {
+		return err
+	}
+	// there is metadata for the documents we did not save as well
+	localFiles := make(map[string]queue.Metadata, len(all))
+	for urlString, metadata := range all {
+		if len(metadata.Path) > 0 {
+			localFiles[urlString] = metadata
+		}
+	}
+	c := &linkConverter{
+		localFiles: localFiles,
+		localPaths: make(map[string]struct{}, len(localFiles)),
+	}
+	for _, localFile := range localFiles {
+		c.localPaths[localFile.Path] = struct{}{}
+	}
+
+	var converted int
+	for urlString, localFile := range localFiles {
+		if localFile.ContentType != "text/html" && localFile.ContentType != "text/css" {
+			continue
+		}
+		docUrlObject, err := url.Parse(urlString)
+		if err != nil {
+			continue
+		}
+
+		fullFilename := filepath.Join(crawlingDir, filepath.FromSlash(localFile.Path))
+		content, err := os.ReadFile(fullFilename)
+		if err != nil {
+			logger.Error().Err(err).Str("fullFilename", fullFilename).Msg("can't read file")
+			continue
+		}
+
+		// we parse UTF-8, and write back in whatever encoding the file was in
+		var fileEncoding encoding.Encoding
+		if len(localFile.Charset) > 0 && !isUTF8(localFile.Charset) && !localFile.Transcoded {
+			fileEncoding, _ = charset.Lookup(localFile.Charset)
+		}
+		if fileEncoding != nil {
+			content, err = decodeDocument(content, fileEncoding)
+			if err != nil {
+				logger.Error().Err(err).Str("fullFilename", fullFilename).Str("charset", localFile.Charset).Msg("can't decode file")
+				continue
+			}
+		}
+
+		if localFile.ContentType == "text/html" {
+			content, err = c.convertHTML(content, docUrlObject, localFile.Path)
+			if err != nil {
+				logger.Error().Err(err).Str("fullFilename", fullFilename).Msg("can't convert html")
+				continue
+			}
+		} else {
+			content = []byte(c.convertCSS(string(content), docUrlObject, localFile.Path))
+		}
+
+		if fileEncoding != nil {
+			content, err = encodeDocument(content, fileEncoding, localFile.ContentType)
+			if err != nil {
+				logger.Error().Err(err).Str("fullFilename", fullFilename).Str("charset", localFile.Charset).Msg("can't encode file")
+				continue
+			}
+		}
+
+		// write and rename, so we never leave a half-written file
+		err = os.WriteFile(fullFilename+".temp", content, settings.FilePermissions)
+		if err == nil {
+			err = os.Rename(fullFilename+".temp", fullFilename)
+		}
+		if err != nil {
+			logger.Error().Err(err).Str("fullFilename", fullFilename).Msg("can't write converted file")
+			continue
+		}
+		converted++
+	}
+	logger.Info().Int("converted", converted).Msg("links are converted")
+
+	return nil
+}
+
+// rewrite returns a replacement for a given link, found in the document
+// stored at fromPath, which should be resolved against base
+func (c *linkConverter) rewrite(link string, base *url.URL, fromPath string) string {
+	trimmed := strings.TrimSpace(link)
+	lowered := strings.ToLower(trimmed)
+	if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") ||
+		strings.HasPrefix(lowered, "data:") || strings.HasPrefix(lowered, "javascript:") || strings.HasPrefix(lowered, "mailto:") {
+		return link
+	}
+	linkUrlObject, err := url.Parse(trimmed)
+	if err != nil {
+		return link
+	}
+
+	// the link could be already converted (if we convert the second time), or
+	// it could be relative from the start and point to the right file already
+	if !linkUrlObject.IsAbs() && len(linkUrlObject.Host) == 0 && len(linkUrlObject.Path) > 0 && !strings.HasPrefix(linkUrlObject.Path, "/") {
+		if _, ok := c.localPaths[path.Join(path.Dir(fromPath), linkUrlObject.Path)]; ok {
+			return link
+		}
+	}
+
+	absoluteUrlObject := base.ResolveReference(linkUrlObject)
+	normalizedUrlObject, err := utils.NormalizeUrlObject(absoluteUrlObject)
+	if err != nil {
+		return absoluteUrlObject.String()
+	}
+	// normalization could drop the fragment, but the link still needs it
+	fragment := absoluteUrlObject.EscapedFragment()
+	normalizedUrlObject.Fragment, normalizedUrlObject.RawFragment = "", ""
+
+	localFile, ok := c.localFiles[normalizedUrlObject.String()]
+	if !ok {
+		return absoluteUrlObject.String()
+	}
+
+	relativePath, err := filepath.Rel(filepath.FromSlash(path.Dir(fromPath)), filepath.FromSlash(localFile.Path))
+	if err != nil {
+		return absoluteUrlObject.String()
+	}
+	segments := strings.Split(filepath.ToSlash(relativePath), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	relativeLink := strings.Join(segments, "/")
+	// PathEscape leaves colons as they are, and "a:b.html" would be taken for
+	// a link with the "a" scheme
+	if strings.Contains(segments[0], ":") {
+		relativeLink = "./" + relativeLink
+	}
+	if len(fragment) > 0 {
+		relativeLink = relativeLink + "#" + fragment
+	}
+
+	return relativeLink
+}
+
+func (c *linkConverter) convertHTML(content []byte, docUrlObject *url.URL, fromPath string) ([]byte, error) {
+	doc, err := html.Parse(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	_, base := extractHTMLLinks(doc, docUrlObject)
+	rewrite := func(link string) string {
+		return c.rewrite(link, base, fromPath)
+	}
+
+	var convertNode func(*html.Node)
+	convertNode = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			// all the links are resolved against base already, and with it
+			// our relative links would point to nowhere
+			if n.Data == "base" {
+				attrs := n.Attr[:0]
+				for _, a := range n.Attr {
+					if a.Key != "href" {
+						attrs = append(attrs, a)
+					}
+				}
+				n.Attr = attrs
+			}
+
+			for _, rule := range linkRules[n.Data] {
+				if rule.applies != nil && !rule.applies(n) {
+					continue
+				}
+				for i, a := range n.Attr {
+					if a.Key == rule.attr {
+						n.Attr[i].Val = rule.style.rewriteLinks(a.Val, rewrite)
+					}
+				}
+			}
+
+			for i, a := range n.Attr {
+				if a.Key == "style" {
+					n.Attr[i].Val = c.convertCSS(a.Val, base, fromPath)
+				}
+			}
+			if n.Data == "style" {
+				for child := n.FirstChild; child != nil; child = child.NextSibling {
+					if child.Type == html.TextNode {
+						child.Data = c.convertCSS(child.Data, base, fromPath)
+					}
+				}
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			convertNode(child)
+		}
+	}
+	convertNode(doc)
+
+	var buf bytes.Buffer
+	err = html.Render(&buf, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// convertCSS rewrites the links matched by the same regexps we use to find
+// them, keeping the original quoting style
+func (c *linkConverter) convertCSS(css string, base *url.URL, fromPath string) string {
+	replace := func(re *regexp.Regexp, format func(quote, link string) string) {
+		css = re.ReplaceAllStringFunc(css, func(match string) string {
+			groups := re.FindStringSubmatch(match)
+			quotes := []string{`"`, `'`, ``}
+			for i, link := range groups[1:] {
+				if len(link) > 0 && !strings.HasPrefix(strings.ToLower(strings.TrimSpace(link)), "data:") {
+					return format(quotes[i], c.rewrite(link, base, fromPath))
+				}
+			}
+			return match
+		})
+	}
+	replace(cssImportRe, func(quote, link string) string {
+		return "@import " + quote + link + quote
+	})
+	replace(cssURLRe, func(quote, link string) string {
+		return "url(" + quote + link + quote + ")"
+	})
+
+	return css
+}
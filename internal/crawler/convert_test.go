@@ -0,0 +1,91 @@
+package crawler
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/text/encoding/charmap"
+
+	"github.com/skaurus/ta-site-crawler/internal/queue"
+	"github.com/skaurus/ta-site-crawler/internal/scope"
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+// a document in a legacy encoding can reference characters that encoding does
+// not have; html.Parse decodes such references, so they must be escaped again
+// when the converted document is encoded back. also, a local file name with a
+// colon must not be taken for a scheme
+func TestConvertLinks(t *testing.T) {
+	outputDir := t.TempDir()
+	startUrlObject, _ := url.Parse("https://example.com/")
+	hostPolicy, err := scope.NewHostPolicy(scope.HostPolicyWWW, startUrlObject, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := zerolog.Nop()
+	settings.Save(settings.Params{
+		URL:          startUrlObject,
+		OutputDir:    outputDir,
+		Logger:       &logger,
+		OutputFormat: settings.OutputFormatFiles,
+		Scope:        scope.NewFilter(nil),
+		HostPolicy:   hostPolicy,
+		QueueBackend: queue.BackendMemory,
+	})
+
+	q, err := queue.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = q.Cleanup()
+	}()
+
+	crawlingDir := filepath.Join(outputDir, settings.CrawlingDir)
+	if err := os.MkdirAll(crawlingDir, settings.DirPermissions); err != nil {
+		t.Fatal(err)
+	}
+	// "Привет" is in windows-1251, and "中" is not
+	original, err := charmap.Windows1251.NewEncoder().String(
+		`<html><head><meta charset="windows-1251"></head><body><a href="/b">Привет &#x4e2d;</a><a href="/c:d">c:d</a></body></html>`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(crawlingDir, "a.html"), []byte(original), settings.FilePermissions); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(crawlingDir, "b.html"), []byte("<html></html>"), settings.FilePermissions); err != nil {
+		t.Fatal(err)
+	}
+	for urlString, metadata := range map[string]queue.Metadata{
+		"https://example.com/a": {Path: "a.html", ContentType: "text/html", Charset: "windows-1251"},
+		"https://example.com/b": {Path: "b.html", ContentType: "text/html", Charset: "utf-8"},
+		// only documents are read, so there is no need for a file (and it
+		// could not be created on Windows anyway)
+		"https://example.com/c:d": {Path: "c:d.png", ContentType: "image/png"},
+	} {
+		if err := q.SetMetadata(urlString, metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ConvertLinks(q); err != nil {
+		t.Fatal(err)
+	}
+
+	converted, err := os.ReadFile(filepath.Join(crawlingDir, "a.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	privet, _ := charmap.Windows1251.NewEncoder().String("Привет")
+	for _, expected := range []string{`href="b.html"`, privet + " &#20013;", `href="./c:d.png"`} {
+		if !bytes.Contains(converted, []byte(expected)) {
+			t.Errorf("converted document %q does not contain %q", converted, expected)
+		}
+	}
+}
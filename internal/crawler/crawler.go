@@ -1,14 +1,17 @@
 package crawler
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -18,10 +21,12 @@ import (
 	"golang.org/x/net/context"
 	"golang.org/x/net/html"
 	"golang.org/x/net/publicsuffix"
+	"golang.org/x/text/encoding"
 
 	"github.com/skaurus/ta-site-crawler/internal/queue"
 	"github.com/skaurus/ta-site-crawler/internal/settings"
 	"github.com/skaurus/ta-site-crawler/internal/utils"
+	"github.com/skaurus/ta-site-crawler/internal/warc"
 )
 
 type worker struct {
@@ -44,46 +49,79 @@ var (
 
 	cookieJar  *cookiejar.Jar
 	httpClient *http.Client
+	// nil unless WARC output is enabled
+	warcWriter *warc.Writer
 
-	pauseBetweenJobs = 200 * time.Millisecond
-
-	// https://stackoverflow.com/a/48704300/320345
-	allowedContentTypes2Ext = map[string]string{
-		"text/html":              "html",
-		"text/css":               "css",
-		"application/javascript": "js",
-		"text/javascript":        "js",
-		"text/plain":             "txt",
-		"application/json":       "json",
-		"application/xml":        "xml",
-		"text/xml":               "xml",
-	}
-
-	// the list is not complete, see https://stackoverflow.com/a/2725168/320345
-	// but let's try to find a compromise between completeness and number of lines
-	// also, of course we are interested in attributes that we can reasonably expect
-	// to contain a link to a text document
-	tags2LinkAttribute = map[string]string{
-		"a":          "href",
-		"blockquote": "cite",
-		"iframe":     "src",
-		"link":       "href",
-		"script":     "src",
-	}
+	// how long to wait before asking the queue again, if it had nothing for us
+	pauseWhenIdle = 200 * time.Millisecond
+	// how many found urls are queued in one transaction, see enqueueFoundURLs
+	enqueueBatchSize = 1000
+
+	defaultSoftware = "ta-site-crawler"
 )
 
-func Init() (err error) {
+func Init(q queue.Queue) (err error) {
 	cookieJar, err = cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
 	if err != nil {
 		panic(fmt.Sprintf("can't create cookie jar: %v", err))
 	}
 
 	httpClient = &http.Client{
-		Jar:     cookieJar,
-		Timeout: time.Duration(settings.Get().HTTPTimeout()) * time.Second,
+		Jar:           cookieJar,
+		Timeout:       time.Duration(settings.Get().HTTPTimeout()) * time.Second,
+		CheckRedirect: checkRedirect,
 	}
 
-	return nil
+	// let's get robots.txt of the starting host right away (that happens on
+	// every start, resume included), so the first log lines will tell if it
+	// forbids us something; other hosts (if any) will be fetched lazily
+	if !settings.Get().IgnoreRobots() {
+		_ = robotsFor(settings.Get().URL())
+	}
+
+	if settings.Get().OutputFormat() != settings.OutputFormatFiles {
+		warcWriter, err = newWARCWriter()
+		if err != nil {
+			return err
+		}
+	}
+
+	return initBudget(q)
+}
+
+// Cleanup finishes whatever Init started
+func Cleanup() error {
+	err := saveElapsed()
+	if warcWriter != nil {
+		return errors.Join(err, warcWriter.Close())
+	}
+	return err
+}
+
+func newWARCWriter() (*warc.Writer, error) {
+	runtimeSettings := settings.Get()
+	// everything that affects what ends up in the archive
+	info := warc.SettingsFields(map[string]string{
+		"software":               defaultSoftware,
+		"format":                 "WARC File Format 1.1",
+		"conformsTo":             "https://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/",
+		"isPartOf":               runtimeSettings.URL().String(),
+		"http-header-user-agent": runtimeSettings.UserAgent(),
+		"robots":                 map[bool]string{true: "ignore", false: "obey"}[runtimeSettings.IgnoreRobots()],
+		"skip-sitemaps":          fmt.Sprint(runtimeSettings.SkipSitemaps()),
+		"workers":                fmt.Sprint(runtimeSettings.WorkersCnt()),
+		"rps":                    fmt.Sprint(runtimeSettings.RequestsPerSecond()),
+		"max-connections":        fmt.Sprint(runtimeSettings.MaxConnectionsPerHost()),
+		"http-timeout":           fmt.Sprint(runtimeSettings.HTTPTimeout()),
+		"retry-max-attempts":     fmt.Sprint(runtimeSettings.RetryMaxAttempts()),
+	})
+
+	return warc.NewWriter(
+		filepath.Join(runtimeSettings.OutputDir(), settings.WARCDir),
+		utils.DomainToOutputFolder(runtimeSettings.URL()),
+		runtimeSettings.WARCMaxSize(),
+		info,
+	)
 }
 
 // SpawnWorkers spawns n workers and returns an error if any
@@ -125,11 +163,24 @@ func (w *worker) Run(ctx context.Context, wg *sync.WaitGroup) {
 			wg.Done()
 			return
 		default:
-			// let's not hammer our queue with requests
-			time.Sleep(pauseBetweenJobs)
-
-			err := w.work()
+			if checkBudget() != "" {
+				w.logger.Info().Msg("worker is done, crawl budget is exhausted")
+				wg.Done()
+				return
+			}
+			// there is no sleep between the jobs; how often we make requests
+			// to the site is decided by the limiter (see ratelimit.go)
+			err := w.work(ctx)
 			if err != nil {
+				// let's not hammer our queue with requests
+				time.Sleep(pauseWhenIdle)
+
+				// there are failed tasks waiting for their retry time; we
+				// should not stop, but there is nothing to do right now either
+				if errors.Is(err, queue.ErrOnlyScheduledTasks) {
+					w.logger.Debug().Msg("worker waits for scheduled retries")
+					continue
+				}
 				if errors.Is(err, ErrNoWorkToDo) {
 					w.logger.Info().Msg("worker has no work to do")
 					// even if we got ErrNoWorkToDo, that does not mean that we
@@ -159,21 +210,22 @@ func (w *worker) Run(ctx context.Context, wg *sync.WaitGroup) {
 // also, it violates gocyclo complexity bar (barely), and gocognit (quite seriously).
 // but I feel that any decomposition would make it actually harder to reason about
 // now you see everything in one place, and it is not that hard to read top to bottom
-func (w *worker) work() (err error) { //nolint:gocognit,gocyclo
+func (w *worker) work(ctx context.Context) (err error) { //nolint:gocognit,gocyclo
 	defer func() {
 		if err := recover(); err != nil {
 			w.logger.Error().Any("recover", err).Msg("worker recovered from panic")
 		}
 	}()
 
-	urlString, err := w.q.GetTask()
+	task, err := w.q.GetTask()
 	if err != nil {
 		return err
 	}
+	urlString := task.URL
 	if len(urlString) == 0 {
 		return ErrNoWorkToDo
 	}
-	w.logger.Info().Str("task", urlString).Msg("worker got a task")
+	w.logger.Info().Str("task", urlString).Int("depth", task.Depth).Str("referrer", task.Referrer).Msg("worker got a task")
 
 	atomic.AddUint32(&tasksInProgress, 1)
 	// 🤯, but the "smart guys" say that "every" programmer should know what
@@ -183,159 +235,576 @@ func (w *worker) work() (err error) { //nolint:gocognit,gocyclo
 	// https://en.wikipedia.org/wiki/Two's_complement
 	defer func() { atomic.AddUint32(&tasksInProgress, ^uint32(0)) }()
 
+	// the task is leased to us now, and it must end up either processed or
+	// failed — otherwise it stays leased until the next start. if we return
+	// without calling any of these two (or panic), the task is considered failed,
+	// and will be retried later
+	released := false
+	markAsProcessed := func() {
+		released = true
+		if err := w.q.MarkAsProcessed(urlString); err != nil {
+			w.logger.Error().Err(err).Str("urlString", urlString).Msg("worker can't mark url as processed")
+		}
+	}
+	markAsFailed := func(reason string, retryable bool, retryAfter time.Duration) {
+		released = true
+		var retryAt time.Time
+		if retryable {
+			attempts, err := w.q.Attempts(urlString)
+			if err != nil {
+				w.logger.Error().Err(err).Str("urlString", urlString).Msg("worker can't get number of attempts")
+			}
+			retryAt = nextRetryAt(attempts+1, retryAfter)
+		}
+		if retryAt.IsZero() {
+			w.logger.Warn().Str("urlString", urlString).Str("reason", reason).Msg("worker gives up on url, moving it to dead letters")
+		} else {
+			w.logger.Info().Str("urlString", urlString).Str("reason", reason).Time("retryAt", retryAt).Msg("worker will retry url later")
+		}
+		if err := w.q.MarkAsFailed(urlString, reason, retryAt); err != nil {
+			w.logger.Error().Err(err).Str("urlString", urlString).Msg("worker can't mark url as failed")
+		}
+	}
+	defer func() {
+		if !released {
+			reason := "unexpected failure"
+			if err != nil {
+				reason = err.Error()
+			}
+			markAsFailed(reason, true, 0)
+		}
+	}()
+
 	// TODO do some bookkeeping to track interesting stat
 
 	urlObject, err := url.Parse(urlString)
 	if err != nil {
 		w.logger.Error().Err(err).Str("task", urlString).Msg("worker can't parse an url")
+		markAsFailed("can't parse url", false, 0)
 		return err
 	}
 	if !urlObject.IsAbs() {
 		w.logger.Error().Err(err).Str("task", urlString).Msg("worker got not an absolute url")
+		markAsFailed("not an absolute url", false, 0)
+		return nil
+	}
+	// it could have been queued by the previous run, with other (or without)
+	// canonicalization rules
+	if canonicalUrlObject, err := utils.NormalizeUrlObject(urlObject); err == nil && canonicalUrlObject.String() != urlString {
+		w.logger.Info().Str("task", urlString).Str("canonical", canonicalUrlObject.String()).Msg("url is not canonical, queueing the canonical one instead")
+		enqueueFoundURL(w.q, w.logger, canonicalUrlObject, task.Depth, task.Referrer)
+		markAsProcessed()
+		return nil
+	}
+
+	// it could have been downloaded as a redirect target while it was waiting
+	// in the queue
+	if processed, err := w.q.IsProcessed(urlString); err == nil && processed {
+		w.logger.Info().Str("task", urlString).Msg("url is already processed, skipping")
+		markAsProcessed()
+		return nil
+	}
+
+	// it could have been queued before robots.txt changed, or before we were
+	// started without --ignore-robots
+	switch robotsCheck(urlObject) {
+	case robotsDisallow:
+		w.logger.Info().Str("task", urlString).Msg("url is disallowed by robots.txt, skipping")
+		markAsProcessed()
+		return nil
+	case robotsUnreachable:
+		// we are not allowed to fetch it right now, but that is no reason to
+		// give up on it (the starting url included)
+		markAsFailed("robots.txt is unreachable", true, robotsUnreachableTTL)
 		return nil
 	}
 
 	// let's convert URL path to a file path and name, where we will store
 	// the crawled document
 	w.logger.Debug().Str("urlPath", urlObject.Path).Msg("converting this path to file structure")
-	path, filename := utils.UrlToFileStructure(urlObject)
+	path, filename, err := fileLocation(urlObject)
+	if err != nil {
+		w.logger.Error().Err(err).Str("task", urlString).Msg("worker can't map url to a file")
+		markAsFailed(err.Error(), false, 0)
+		return nil
+	}
 	w.logger.Debug().Str("urlPath", urlObject.Path).Str("path", path).Str("filename", filename).Msg("given path amounted to this file structure")
 	// if this is the case, we will later try to append a proper file extension to it
 	filenameWasEmpty := filename == settings.RootFilename
-	fullPath := settings.Get().OutputDir() + "/" + settings.CrawlingDir + "/" + path
-	fullFilename := fullPath + "/" + filename
+	// path is made of URL segments, so it has forward slashes
+	fullPath := filepath.Join(settings.Get().OutputDir(), settings.CrawlingDir, filepath.FromSlash(path))
+	fullFilename := filepath.Join(fullPath, filename)
+	// with WARC-only output, there is no file tree at all
+	writeFiles := settings.Get().OutputFormat() != settings.OutputFormatWARC
+
+	// on recrawl, existing files are expected, and we need to know what we got
+	// the previous time
+	recrawl := settings.Get().Recrawl()
+	var previous queue.Metadata
+	var known bool
+	if recrawl {
+		previous, known, err = w.q.Metadata(urlString)
+		if err != nil {
+			w.logger.Error().Err(err).Str("urlString", urlString).Msg("worker can't get metadata")
+			return err
+		}
+		unchanged, err := unchangedBySitemap(w.q, urlString, previous)
+		if err != nil {
+			w.logger.Error().Err(err).Str("urlString", urlString).Msg("worker can't get lastmod")
+		}
+		if unchanged {
+			w.logger.Info().Str("urlString", urlString).Msg("document has not changed, according to the sitemap")
+			atomic.AddUint32(&recrawlReport.Unchanged, 1)
+			// its links are all in the queue already, see the 304 case below
+			markAsProcessed()
+			return nil
+		}
+	}
 
-	err = os.MkdirAll(fullPath, settings.DirPermissions)
-	if err != nil {
-		w.logger.Error().Err(err).Str("folder", fullPath).Msg("can't create folder")
-		return
+	if writeFiles {
+		err = os.MkdirAll(fullPath, settings.DirPermissions)
+		if err != nil {
+			w.logger.Error().Err(err).Str("folder", fullPath).Msg("can't create folder")
+			return
+		}
+
+		// check if the file is already downloaded; if it is, there is nothing to do
+		if _, err := os.Stat(fullFilename); err == nil && !recrawl {
+			w.logger.Error().Str("fullFilename", fullFilename).Msg("worker found existing file, skipping")
+			markAsProcessed()
+			return nil
+		}
 	}
 
-	// check if the file is already downloaded; if it is, there is nothing to do
-	if _, err := os.Stat(fullFilename); err == nil {
-		w.logger.Error().Str("fullFilename", fullFilename).Msg("worker found existing file, skipping")
+	limiter := limiterFor(urlObject)
+	err = limiter.acquire(ctx)
+	if err != nil {
+		// we are shutting down; let's keep the lease, and the task will be
+		// requeued on the next start
+		released = true
+		return nil
+	}
+	// the connection slot is given back as soon as the body is on the disk;
+	// the parsing and the rest of the bookkeeping do not hold the host back
+	limiterReleased := false
+	releaseLimiter := func() {
+		if !limiterReleased {
+			limiterReleased = true
+			limiter.release()
+		}
+	}
+	defer releaseLimiter()
+
+	// not using ctx here on purpose: on Ctrl-C we let in-flight requests finish
+	// the remote address is recorded to WARC
+	var remoteIP string
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+				remoteIP = host
+			}
+		},
+	}
+	chain := &redirectChain{q: w.q, from: urlString}
+	req, err := newRequest(withRedirectChain(httptrace.WithClientTrace(context.Background(), trace), chain), urlString)
+	if err != nil {
+		w.logger.Error().Err(err).Msg("worker can't create an http request")
+		return err
+	}
+	conditional := recrawl && setConditionalHeaders(req, previous)
+	requestStartedAt := time.Now()
+	resp, err := httpClient.Do(req)
+	if errors.Is(err, errTooManyRedirects) {
+		limiter.observe(time.Since(requestStartedAt), 0)
+		w.logger.Warn().Err(err).Str("urlString", urlString).Any("redirectChain", chain.hops).Msg("worker got too many redirects")
+		// it will not get any better with retries
+		markAsFailed(err.Error(), false, 0)
 		return nil
 	}
-
-	resp, err := httpClient.Get(urlString)
 	if err != nil {
 		w.logger.Error().Err(err).Msg("worker got an http error")
+		// timeouts are a sign of the site struggling too
+		limiter.observe(time.Since(requestStartedAt), 0)
 		return err
 	}
+	limiter.observe(time.Since(requestStartedAt), resp.StatusCode)
 	defer func() {
 		_ = resp.Body.Close()
 	}()
 
+	// we keep it for every response, so it is possible to tell later what
+	// exactly we got from the site
+	metadata := queue.Metadata{
+		StatusCode:    resp.StatusCode,
+		FinalURL:      resp.Request.URL.String(),
+		RedirectChain: chain.hops,
+		ETag:          resp.Header.Get("ETag"),
+		LastModified:  resp.Header.Get("Last-Modified"),
+		Header:        resp.Header,
+		FetchedAt:     requestStartedAt.UTC(),
+		FetchTook:     time.Since(requestStartedAt),
+	}
+	saveMetadata := func() {
+		if err := w.q.SetMetadata(urlString, metadata); err != nil {
+			w.logger.Error().Err(err).Str("urlString", urlString).Msg("worker can't save metadata")
+		}
+	}
+
+	if resp.StatusCode == http.StatusNotModified && conditional {
+		w.logger.Info().Str("urlString", urlString).Msg("document has not changed")
+		atomic.AddUint32(&recrawlReport.Unchanged, 1)
+		// the document is the same, and so are its links — they are all in
+		// the queue already, because the whole previous pass was requeued
+		fetchedAt, fetchTook := metadata.FetchedAt, metadata.FetchTook
+		metadata = previous
+		metadata.FetchedAt, metadata.FetchTook = fetchedAt, fetchTook
+		// 304 has to carry the validators, if they have changed
+		if etag := resp.Header.Get("ETag"); len(etag) > 0 {
+			metadata.ETag = etag
+		}
+		if lastModified := resp.Header.Get("Last-Modified"); len(lastModified) > 0 {
+			metadata.LastModified = lastModified
+		}
+		saveMetadata()
+		markAsProcessed()
+		return nil
+	}
+
+	if len(chain.notFollowed) > 0 {
+		// that is the redirect response itself
+		metadata.RedirectChain = append(metadata.RedirectChain, queue.Redirect{URL: metadata.FinalURL, StatusCode: resp.StatusCode})
+		w.logger.Info().Str("urlString", urlString).Str("target", chain.notFollowed).Str("reason", chain.notFollowedReason).Msg("worker does not follow the redirect")
+		// so the links to this URL lead to the right file after conversion
+		if targetMetadata, found, err := w.q.Metadata(chain.notFollowed); err == nil && found {
+			metadata.Path = targetMetadata.Path
+		}
+		saveMetadata()
+		markAsProcessed()
+		return nil
+	}
+
+	// the document belongs to the URL we were redirected to: it is stored
+	// under its path, and the links in it are relative to it. the task URL
+	// keeps pointing to it in the metadata
+	docUrlString := urlString
+	if len(chain.hops) > 0 {
+		finalUrlObject, err := utils.NormalizeUrlObject(resp.Request.URL)
+		if err != nil {
+			w.logger.Error().Err(err).Str("finalURL", metadata.FinalURL).Msg("worker can't normalize the redirect target")
+			return err
+		}
+		urlObject, docUrlString = finalUrlObject, finalUrlObject.String()
+	}
+	if docUrlString != urlString {
+		w.logger.Info().Str("urlString", urlString).Str("finalURL", docUrlString).Int("redirects", len(chain.hops)).Msg("worker was redirected")
+		path, filename, err = fileLocation(urlObject)
+		if err != nil {
+			w.logger.Error().Err(err).Str("finalURL", docUrlString).Msg("worker can't map url to a file")
+			markAsFailed(err.Error(), false, 0)
+			return nil
+		}
+		filenameWasEmpty = filename == settings.RootFilename
+		fullPath = filepath.Join(settings.Get().OutputDir(), settings.CrawlingDir, filepath.FromSlash(path))
+		fullFilename = filepath.Join(fullPath, filename)
+		if writeFiles {
+			err = os.MkdirAll(fullPath, settings.DirPermissions)
+			if err != nil {
+				w.logger.Error().Err(err).Str("folder", fullPath).Msg("can't create folder")
+				return err
+			}
+		}
+	}
+
 	if statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300; !statusOK {
 		w.logger.Warn().Int("statusCode", resp.StatusCode).Msg("worker got bad http status code")
+		switch {
+		case !recrawl || !hadDocument(previous, known):
+			saveMetadata()
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			// the local file is kept, and the metadata tells it is gone
+			atomic.AddUint32(&recrawlReport.Disappeared, 1)
+			metadata.Path = previous.Path
+			saveMetadata()
+		default:
+			// a temporary failure should not make us forget what we have
+		}
+		markAsFailed(resp.Status, isRetryableStatus(resp.StatusCode), parseRetryAfter(resp.Header))
 		return nil
 	}
 
-	contentType := resp.Header.Get("Content-Type")
-	// now, content-type will likely be something like "text/html; charset=utf-8",
-	// and we are interested in just "text/html". also, I'm pretty sure in the wild
-	// big Internet it can be something like "text/html ;charset = utf-8" and browsers
-	// will still work. maybe it could be even worse
-	contentTypeParts := strings.Split(contentType, ";")
-	contentType = strings.ToLower(strings.TrimSpace(contentTypeParts[0]))
-	fileExt, ok := allowedContentTypes2Ext[contentType]
+	contentType := mediaType(resp.Header.Get("Content-Type"))
+	// if the server does not tell what it is, we have to look at it ourselves
+	bodyReader := bufio.NewReaderSize(resp.Body, sniffLength)
+	if isGenericContentType(contentType) {
+		head, _ := bodyReader.Peek(sniffLength)
+		sniffed := sniffContentType(urlObject, head)
+		w.logger.Info().Str("urlString", urlString).Str("declared", contentType).Str("sniffed", sniffed).Msg("worker had to sniff content-type")
+		contentType = sniffed
+	}
+	metadata.ContentType = contentType
+	fileExt, ok := settings.Get().ContentTypes()[contentType]
 	if !ok {
 		w.logger.Warn().Str("contentType", contentType).Str("urlString", urlString).Msg("worker got a non-text content-type")
+		saveMetadata()
+		// there is nothing to do with it, and there is no point to try again
+		markAsProcessed()
 		return nil
 	}
 	fullFilenameWithoutExt := ""
 	// besides filenameWasEmpty case, we can have non-empty filenames without
 	// the extension. let's make them prettier too
 	if !strings.Contains(filename, ".") {
-		// this new value is not used later in function, and golangci-lint is
-		// not happy about it. but I prefer to keep it consistent, because
-		// code can change later
-		filename = filename + "." + fileExt //nolint:ineffassign,staticcheck
+		filename = filename + "." + fileExt
 		fullFilenameWithoutExt = fullFilename
 		fullFilename = fullFilename + "." + fileExt
 	}
 
-	// os.O_CREATE|os.O_EXCL requires file to not exist
-	tempFile, err := os.OpenFile(fullFilename+".temp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, settings.FilePermissions)
-	if err != nil {
-		w.logger.Error().Err(err).Str("fullFilename_temp", fullFilename+".temp").Msg("worker can't create a temp file")
-		return err
+	// Content-Length can lie, or be absent, so the limit is enforced while
+	// reading too (see below)
+	maxSize := settings.Get().MaxDocumentSize()
+	if resp.ContentLength > maxSize {
+		w.logger.Warn().Str("urlString", urlString).Int64("contentLength", resp.ContentLength).Int64("maxSize", maxSize).Msg("document is too big, skipping")
+		metadata.Oversized = true
+		saveMetadata()
+		markAsProcessed()
+		return nil
 	}
-	// io.Copy directly to tempFile would be nice, but we will need the body later
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		w.logger.Error().Err(err).Msg("worker can't read response body")
-		return err
+
+	// two URLs can still end up with the same file name (say, query parameters
+	// are not encoded unambiguously); the one that came first keeps it. a
+	// document we skip does not get to claim anything
+	relativeFilename := strings.TrimPrefix(path+"/"+filename, "/")
+	if writeFiles {
+		owner, err := w.q.ClaimPath(utils.PathKey(relativeFilename), docUrlString)
+		if err != nil {
+			w.logger.Error().Err(err).Str("path", relativeFilename).Msg("worker can't claim a file path")
+			return err
+		}
+		if owner != docUrlString {
+			filename = utils.DisambiguateFilename(filename, docUrlString)
+			w.logger.Warn().Str("urlString", docUrlString).Str("owner", owner).Str("filename", filename).Msg("file name is taken by another url, using another one")
+			fullFilename = filepath.Join(fullPath, filename)
+			relativeFilename = strings.TrimPrefix(path+"/"+filename, "/")
+			if _, err := w.q.ClaimPath(utils.PathKey(relativeFilename), docUrlString); err != nil {
+				w.logger.Error().Err(err).Str("path", relativeFilename).Msg("worker can't claim a file path")
+				return err
+			}
+		}
+	}
+
+	// the body is streamed to a temp file: with the file tree output it then
+	// becomes the document itself, and with WARC-only output it is a scratch
+	// file to make the record from
+	var bodyFile *os.File
+	var bodyFilename string
+	if writeFiles {
+		bodyFilename = fullFilename + ".temp"
+		// os.O_CREATE|os.O_EXCL requires file to not exist
+		bodyFile, err = os.OpenFile(bodyFilename, os.O_RDWR|os.O_CREATE|os.O_EXCL, settings.FilePermissions)
+		if os.IsExist(err) {
+			// if we were killed while writing it, the leased task was requeued, and
+			// now we see the leftover from that previous attempt
+			w.logger.Warn().Str("fullFilename_temp", bodyFilename).Msg("worker found a stale temp file, removing it")
+			_ = os.Remove(bodyFilename)
+			bodyFile, err = os.OpenFile(bodyFilename, os.O_RDWR|os.O_CREATE|os.O_EXCL, settings.FilePermissions)
+		}
+	} else {
+		bodyFile, err = os.CreateTemp(settings.Get().OutputDir(), "body-*.temp")
+		if err == nil {
+			bodyFilename = bodyFile.Name()
+		}
 	}
-	_, err = tempFile.Write(body)
 	if err != nil {
-		w.logger.Error().Err(err).Str("fullFilename_temp", fullFilename+".temp").Msg("worker can't write response body to a temp file")
+		w.logger.Error().Err(err).Str("fullFilename_temp", bodyFilename).Msg("worker can't create a temp file")
 		return err
 	}
+	// unless it was renamed to the document file, the temp file is not needed
+	bodyFileRenamed := false
+	defer func() {
+		_ = bodyFile.Close()
+		if !bodyFileRenamed {
+			_ = os.Remove(bodyFilename)
+		}
+	}()
 
-	// now we can atomically rename the file
-	err = os.Rename(fullFilename+".temp", fullFilename)
+	// only HTML and CSS are parsed for links, so only they are kept in memory
+	keepForParsing := contentType == "text/html" || contentType == "text/css"
+	streamed, err := streamBody(bodyFile, bodyReader, maxSize, keepForParsing)
+	// a truncated body is not read to the end, so the connection is closed
+	// before the slot is given back
+	_ = resp.Body.Close()
+	releaseLimiter()
 	if err != nil {
-		w.logger.Error().Err(err).Str("fullFilename_temp", fullFilename+".temp").Str("fullFilename", fullFilename).Msg("worker can't rename temp file")
+		w.logger.Error().Err(err).Msg("worker can't read response body")
 		return err
 	}
-	// to make that early exit above ("found existing file, skipping") work, we
-	// will write a marker file
-	if filenameWasEmpty {
-		// I feel that this edge case is not such a big deal to stop working on the task
-		// that's why I ignore the error
-		_ = os.WriteFile(
-			fullFilenameWithoutExt,
-			[]byte(fmt.Sprintf("princess is in another castle: %s.%s\n(this is a marker file, please do not delete it)", settings.RootFilename, fileExt)),
-			settings.FilePermissions,
-		)
-	}
-	err = w.q.MarkAsProcessed(urlString)
-	if err != nil {
-		w.logger.Error().Err(err).Str("urlString", urlString).Msg("worker can't mark url as processed")
+	if streamed.truncated {
+		w.logger.Warn().Str("urlString", urlString).Int64("maxSize", maxSize).Msg("document is too big, it is truncated")
+		metadata.Truncated = true
+	}
+	if streamed.parsedPartially {
+		w.logger.Info().Str("urlString", urlString).Int("parsedSize", maxParsedSize).Msg("document is big, only its beginning is parsed for links")
+	}
+	if err := recordUsage(streamed.size); err != nil {
+		w.logger.Error().Err(err).Msg("worker can't save crawl budget usage")
+	}
+	metadata.Size = streamed.size
+	metadata.Digest = streamed.digest
+	metadata.FetchTook = time.Since(requestStartedAt)
+	if recrawl {
+		countRecrawled(previous, known, metadata.Digest)
+	}
+
+	// links are looked for in the UTF-8 version of the document
+	parsed := streamed.parsed
+	var docEncoding encoding.Encoding
+	if keepForParsing {
+		docEncoding, metadata.Charset = documentEncoding(streamed.parsed, contentType, resp.Header.Get("Content-Type"))
+		if !isUTF8(metadata.Charset) {
+			decoded, err := decodeDocument(parsed, docEncoding)
+			if err != nil {
+				// a garbled link or two is better than nothing
+				w.logger.Warn().Err(err).Str("urlString", urlString).Str("charset", metadata.Charset).Msg("worker can't decode document, parsing it as is")
+			} else {
+				parsed = decoded
+			}
+		}
 	}
 
 	// now we need to parse the body and find all links from the same domain.
 	// of course, in production I would write a simple regexp to do this... /sarcasm
 	// https://stackoverflow.com/a/1732454/320345 never gets old
 	// on a serious note, we will try to parse only the text/html documents
-	if contentType != "text/html" {
-		return nil
+	// (and the stylesheets, but CSS is a different story, see css.go)
+	var foundURLs []string
+	// relative links in a stylesheet are relative to the stylesheet itself,
+	// and in HTML — to the document, unless there is a <base href>
+	baseUrlObject := urlObject
+	var canonicalUrlObject *url.URL
+	switch contentType {
+	case "text/html":
+		doc, err := html.Parse(bytes.NewReader(parsed))
+		if err != nil {
+			w.logger.Error().Err(err).Str("urlString", urlString).Msg("worker can't parse html")
+			return err
+		}
+		foundURLs, baseUrlObject = extractHTMLLinks(doc, urlObject)
+		canonicalUrlObject = findCanonical(doc, baseUrlObject, resp.Header, urlObject)
+	case "text/css":
+		foundURLs = extractCSSLinks(string(parsed))
 	}
-	doc, err := html.Parse(bytes.NewReader(body))
-	if err != nil {
-		w.logger.Error().Err(err).Str("urlString", urlString).Msg("worker can't parse html")
-		return err
+	// links from the headers are always relative to the document URL, so we
+	// resolve them right away
+	for _, headerLink := range extractHeaderLinks(resp.Header) {
+		if headerUrlObject, err := url.Parse(headerLink); err == nil {
+			foundURLs = append(foundURLs, urlObject.ResolveReference(headerUrlObject).String())
+		}
+	}
+	if canonicalUrlObject == nil {
+		canonicalUrlObject = findCanonical(nil, nil, resp.Header, urlObject)
 	}
 
-	foundURLs := make([]string, 0)
-	// https://pkg.go.dev/golang.org/x/net/html#example-Parse
-	var parseNode func(*html.Node)
-	parseNode = func(n *html.Node) {
-		if n.Type == html.ElementNode {
-			lookingForAttr, ok := tags2LinkAttribute[n.Data]
-			if ok {
-				for _, a := range n.Attr {
-					if a.Key == lookingForAttr {
-						foundURLs = append(foundURLs, a.Val)
-						break
-					}
-				}
+	// if the document says it is a duplicate of another one, and we are going
+	// to crawl that other one (or already did), there is no need to keep this
+	// one. otherwise (say, the canonical URL is out of scope), we keep it
+	if canonicalUrlObject != nil && settings.Get().HonorCanonical() {
+		canonicalUrlObject, err = utils.NormalizeUrlObject(canonicalUrlObject)
+		if err == nil && canonicalUrlObject.String() != docUrlString {
+			metadata.Canonical = canonicalUrlObject.String()
+			if w.followCanonical(canonicalUrlObject, task) {
+				w.logger.Info().Str("urlString", urlString).Str("canonical", metadata.Canonical).Msg("document is a duplicate of its canonical url, skipping")
+				saveMetadata()
+				markAsProcessed()
+				return nil
 			}
 		}
-		for child := n.FirstChild; child != nil; child = child.NextSibling {
-			parseNode(child)
+	}
+
+	if warcWriter != nil {
+		err = warcWriter.WriteExchange(warc.Exchange{
+			// that is the request as it was actually sent, cookies included
+			Request:   resp.Request,
+			Response:  resp,
+			Body:      bodyFile,
+			BodySize:  streamed.size,
+			Truncated: streamed.truncated,
+			IPAddress: remoteIP,
+			Date:      requestStartedAt,
+		})
+		if err != nil {
+			w.logger.Error().Err(err).Str("urlString", urlString).Msg("worker can't write to WARC")
+			return err
 		}
 	}
-	parseNode(doc)
 
-	workingHost, err := utils.UrlToHost(urlObject)
-	if err != nil {
-		// that should be impossible, because we already checked that the current
-		// domain does not make UrlToHost to fail (see panic in DomainToOutputFolder)
-		w.logger.Error().Err(err).Str("urlString", urlString).Msg("UrlToHost failed")
-		return err
+	if writeFiles && settings.Get().TranscodeUTF8() && docEncoding != nil && !isUTF8(metadata.Charset) {
+		// WARC keeps the document as it was, and the file tree gets the UTF-8
+		// version of it
+		utf8Filename := fullFilename + ".utf8.temp"
+		utf8File, err := os.OpenFile(utf8Filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, settings.FilePermissions)
+		if err == nil {
+			err = transcodeDocument(utf8File, bodyFile, docEncoding, contentType)
+			if err != nil {
+				_ = utf8File.Close()
+				_ = os.Remove(utf8Filename)
+			}
+		}
+		if err != nil {
+			// the original is still there, so that is not a reason to fail
+			w.logger.Warn().Err(err).Str("urlString", urlString).Str("charset", metadata.Charset).Msg("worker can't transcode document to UTF-8, saving it as is")
+		} else {
+			_ = bodyFile.Close()
+			_ = os.Remove(bodyFilename)
+			// the deferred cleanup takes care of the new one now
+			bodyFile, bodyFilename = utf8File, utf8Filename
+			metadata.Transcoded = true
+		}
+	}
+
+	if writeFiles {
+		err = bodyFile.Close()
+		if err != nil {
+			w.logger.Error().Err(err).Str("fullFilename_temp", bodyFilename).Msg("worker can't close a temp file")
+			return err
+		}
+
+		// now we can atomically rename the file
+		err = os.Rename(bodyFilename, fullFilename)
+		if err != nil {
+			w.logger.Error().Err(err).Str("fullFilename_temp", bodyFilename).Str("fullFilename", fullFilename).Msg("worker can't rename temp file")
+			return err
+		}
+		bodyFileRenamed = true
+		// to make that early exit above ("found existing file, skipping") work, we
+		// will write a marker file
+		if filenameWasEmpty {
+			// I feel that this edge case is not such a big deal to stop working on the task
+			// that's why I ignore the error
+			_ = os.WriteFile(
+				fullFilenameWithoutExt,
+				[]byte(fmt.Sprintf("princess is in another castle: %s.%s\n(this is a marker file, please do not delete it)", settings.RootFilename, fileExt)),
+				settings.FilePermissions,
+			)
+		}
+		// that is needed to convert the links for offline browsing later
+		metadata.Path = relativeFilename
+	}
+	saveMetadata()
+	markAsProcessed()
+	if docUrlString != urlString {
+		// the redirect target is done too, and it should not be downloaded again
+		// if it is found (or is queued already)
+		targetMetadata := metadata
+		targetMetadata.RedirectChain = nil
+		if err := w.q.SetMetadata(docUrlString, targetMetadata); err != nil {
+			w.logger.Error().Err(err).Str("urlString", docUrlString).Msg("worker can't save metadata")
+		}
+		if err := w.q.MarkAsProcessed(docUrlString); err != nil {
+			w.logger.Error().Err(err).Str("urlString", docUrlString).Msg("worker can't mark url as processed")
+		}
 	}
+
+	foundTasks := make([]queue.Task, 0, len(foundURLs))
 	for _, foundURL := range foundURLs {
 		newUrlObject, err := url.Parse(foundURL)
 		if err != nil {
@@ -343,46 +812,128 @@ func (w *worker) work() (err error) { //nolint:gocognit,gocyclo
 			continue
 		}
 
-		newUrlObject = urlObject.ResolveReference(newUrlObject)
+		newUrlObject = baseUrlObject.ResolveReference(newUrlObject)
 		newUrlObject, err = utils.NormalizeUrlObject(newUrlObject)
 		if err != nil {
 			w.logger.Error().Err(err).Str("foundURL", foundURL).Msg("worker can't parse normalized version of found url")
-		}
-
-		newUrlHost, err := utils.UrlToHost(newUrlObject)
-		if err != nil {
-			// we didn't fail in UrlToHost with the current domain (see panic
-			// in DomainToOutputFolder); if we fail here, that means it is a
-			// different host, so we should skip it
 			continue
 		}
-		if newUrlHost != workingHost {
-			continue
+
+		if followable(w.logger, newUrlObject) {
+			foundTasks = append(foundTasks, queue.Task{URL: newUrlObject.String(), Depth: task.Depth + 1, Referrer: docUrlString})
 		}
+	}
+	enqueueFoundURLs(w.q, w.logger, foundTasks)
 
-		urlToProcess := newUrlObject.String()
+	return nil
+}
 
-		isProcessed, err := w.q.IsProcessed(urlToProcess)
-		if err != nil {
-			w.logger.Error().Err(err).Str("urlToProcess", urlToProcess).Msg("worker can't check if found url is processed")
-		}
-		if isProcessed {
-			continue
+// fileLocation maps a URL to the folder and the file name of its document,
+// relative to the crawling dir
+func fileLocation(urlObject *url.URL) (path, filename string, err error) {
+	path, filename = utils.UrlToFileStructure(urlObject)
+	// with more than one host, each of them gets its own subtree
+	if settings.Get().HostPolicy().MultiHost() {
+		path = strings.TrimSuffix(utils.DomainToOutputFolder(urlObject)+"/"+path, "/")
+	}
+	// UrlToFileStructure takes care of that, but a mistake there would let a
+	// site write anywhere, so we double check
+	if !filepath.IsLocal(filepath.FromSlash(path + "/" + filename)) {
+		return "", "", fmt.Errorf("unsafe file path %q", path+"/"+filename)
+	}
+
+	return path, filename, nil
+}
+
+// followCanonical queues the canonical URL of a task document, if it is not
+// known yet; returns true if it is (or was already) going to be crawled
+func (w *worker) followCanonical(canonicalUrlObject *url.URL, task queue.Task) bool {
+	// it is the same document, so it is as deep as this one
+	switch enqueueFoundURL(w.q, w.logger, canonicalUrlObject, task.Depth, task.Referrer) {
+	case queue.OutcomeQueued, queue.OutcomeAlreadyQueued, queue.OutcomeInProgress:
+		return true
+	case queue.OutcomeProcessed:
+		// two pages pointing to each other as canonical is a thing, and we do
+		// not want to skip both of them
+		canonicalMetadata, found, err := w.q.Metadata(canonicalUrlObject.String())
+		if err == nil && found && len(canonicalMetadata.Canonical) > 0 {
+			return false
 		}
+		return true
+	default:
+		// out of scope, too deep, or we could not queue it
+		return false
+	}
+}
+
+// followable tells if a found URL is worth following: its host is allowed by
+// the host policy, it is in scope, and is not disallowed by robots.txt.
+// Whether we have seen it already is up to the queue. URL is expected to be
+// absolute and normalized already.
+func followable(logger *zerolog.Logger, newUrlObject *url.URL) bool {
+	if !settings.Get().HostPolicy().Allows(newUrlObject) {
+		return false
+	}
+	// we need to make a folder for the host later (see DomainToOutputFolder),
+	// and hosts that UrlToHost fails on are no good for that
+	if _, err := utils.UrlToHost(newUrlObject); err != nil {
+		return false
+	}
+
+	if decision := settings.Get().Scope().Check(newUrlObject); !decision.InScope {
+		logger.Debug().Stringer("urlToProcess", newUrlObject).Stringer("decision", decision).Msg("found url is out of scope")
+		return false
+	}
+
+	if looksLikeNonText(newUrlObject) {
+		return false
+	}
+
+	// with robots.txt unreachable, the url is queued anyway; the worker will
+	// check it again before the fetch
+	if robotsCheck(newUrlObject) == robotsDisallow {
+		logger.Debug().Stringer("urlToProcess", newUrlObject).Msg("found url is disallowed by robots.txt")
+		return false
+	}
 
-		isAlreadyQueued, err := w.q.IsInQueue(urlToProcess)
+	return true
+}
+
+// enqueueFoundURLs adds the found URLs (already checked by followable) that
+// were not seen before to the queue, in one go; the ones that are too deep are
+// recorded as discovered. Returns an outcome for every task.
+func enqueueFoundURLs(q queue.Queue, logger *zerolog.Logger, tasks []queue.Task) []queue.EnqueueOutcome {
+	maxDepth := int(settings.Get().MaxDepth())
+	outcomes := make([]queue.EnqueueOutcome, 0, len(tasks))
+	// every backend lets one write transaction at a time, and the workers need
+	// one to get a task or to finish it. so a long list of links (a sitemap can
+	// have 50k of them) is queued in batches, not to stall them all for long;
+	// a page rarely has more links than fit in one batch anyway
+	for start := 0; start < len(tasks); start += enqueueBatchSize {
+		batch := tasks[start:min(start+enqueueBatchSize, len(tasks))]
+		batchOutcomes, err := q.EnqueueUnseen(batch, maxDepth)
 		if err != nil {
-			w.logger.Error().Err(err).Str("urlToProcess", urlToProcess).Msg("worker can't check if found url is already queued")
-		}
-		if isAlreadyQueued {
-			continue
+			logger.Error().Err(err).Int("tasks", len(batch)).Msg("can't add found urls to queue")
 		}
+		outcomes = append(outcomes, batchOutcomes...)
+	}
 
-		err = w.q.AddTask(urlToProcess)
-		if err != nil {
-			w.logger.Error().Err(err).Str("urlToProcess", urlToProcess).Msg("worker can't add found url to queue")
+	for i, outcome := range outcomes {
+		if outcome == queue.OutcomeDiscovered {
+			logger.Debug().Str("urlToProcess", tasks[i].URL).Int("depth", tasks[i].Depth).Msg("found url is too deep, not following it")
 		}
 	}
 
-	return nil
+	return outcomes
+}
+
+// enqueueFoundURL is enqueueFoundURLs for a single URL, which is checked by
+// followable first. Depth and referrer describe where it was found.
+func enqueueFoundURL(q queue.Queue, logger *zerolog.Logger, newUrlObject *url.URL, depth int, referrer string) queue.EnqueueOutcome {
+	if !followable(logger, newUrlObject) {
+		return queue.OutcomeSkipped
+	}
+
+	task := queue.Task{URL: newUrlObject.String(), Depth: depth, Referrer: referrer}
+	return enqueueFoundURLs(q, logger, []queue.Task{task})[0]
 }
@@ -0,0 +1,60 @@
+package crawler
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// CSS is not as scary as HTML, so here regexps are fine (famous last words).
+// we are interested in @import rules and url() values: the first ones bring
+// other stylesheets, and the second ones bring everything else (fonts, images,
+// but also stylesheets again — `@import url(...)` is a thing)
+
+var (
+	cssCommentRe = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	// `@import url(...)` is matched by cssURLRe, here we need only the strings
+	cssImportRe = regexp.MustCompile(`@import\s+(?:"([^"]*)"|'([^']*)')`)
+	cssURLRe    = regexp.MustCompile(`(?i)url\(\s*(?:"([^"]*)"|'([^']*)'|([^)"'\s]*))\s*\)`)
+
+	// those are surely not text documents, so it makes no sense to request
+	// them only to find out the content-type we do not want. CSS is full of
+	// links like that, but HTML has some too
+	nonTextExtensions = map[string]struct{}{
+		".apng": {}, ".avif": {}, ".bmp": {}, ".gif": {}, ".ico": {}, ".jpeg": {}, ".jpg": {}, ".png": {}, ".svg": {}, ".webp": {},
+		".eot": {}, ".otf": {}, ".ttf": {}, ".woff": {}, ".woff2": {},
+		".mp3": {}, ".mp4": {}, ".ogg": {}, ".wav": {}, ".webm": {},
+		".gz": {}, ".pdf": {}, ".zip": {},
+	}
+)
+
+// extractCSSLinks returns the links found in a stylesheet, or in a style
+// attribute value; those are not resolved yet
+func extractCSSLinks(css string) []string {
+	css = cssCommentRe.ReplaceAllString(css, "")
+
+	var links []string
+	for _, re := range []*regexp.Regexp{cssImportRe, cssURLRe} {
+		for _, match := range re.FindAllStringSubmatch(css, -1) {
+			// only one of the groups (quotes styles) is not empty
+			for _, link := range match[1:] {
+				link = strings.TrimSpace(link)
+				// data: URIs are not links to anything
+				if len(link) > 0 && !strings.HasPrefix(strings.ToLower(link), "data:") {
+					links = append(links, link)
+				}
+			}
+		}
+	}
+
+	return links
+}
+
+// looksLikeNonText tells if URL surely points to something we are not going to
+// download, judging by the extension
+func looksLikeNonText(urlObject *url.URL) bool {
+	_, ok := nonTextExtensions[strings.ToLower(path.Ext(urlObject.Path))]
+	// someone could want SVGs, see --accept-types
+	return ok && len(extensionContentType(urlObject)) == 0
+}
@@ -0,0 +1,292 @@
+package crawler
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// link extraction from HTML is driven by the rules, each of them says which
+// attribute of which tag holds a link, and how to get the link(s) out of the
+// attribute value
+
+type linkStyle int
+
+const (
+	// attribute value is a single URL
+	linkStyleSingle linkStyle = iota
+	// attribute value is a list of "URL descriptor" pairs, like in srcset
+	linkStyleSrcset
+	// attribute value is "<seconds>; url=<URL>", like in <meta http-equiv=refresh>
+	linkStyleRefresh
+)
+
+type linkRule struct {
+	tag   string
+	attr  string
+	style linkStyle
+	// optional additional condition, for the cases when the same attribute of
+	// the same tag holds a link or not depending on something else
+	applies func(n *html.Node) bool
+}
+
+var (
+	// tag -> rules; fill it with registerLinkRule
+	linkRules = map[string][]linkRule{}
+)
+
+func init() {
+	// the list is not complete, see https://stackoverflow.com/a/2725168/320345
+	// but let's try to find a compromise between completeness and number of lines
+	// also, of course we are interested in attributes that we can reasonably expect
+	// to contain a link to a text document (images are here because of srcset;
+	// most of them will be filtered out by their extensions, see css.go)
+	for _, rule := range []linkRule{
+		{tag: "a", attr: "href"},
+		{tag: "area", attr: "href"},
+		{tag: "blockquote", attr: "cite"},
+		{tag: "q", attr: "cite"},
+		{tag: "del", attr: "cite"},
+		{tag: "ins", attr: "cite"},
+		{tag: "iframe", attr: "src"},
+		{tag: "frame", attr: "src"},
+		{tag: "link", attr: "href"},
+		{tag: "script", attr: "src"},
+		{tag: "object", attr: "data"},
+		{tag: "form", attr: "action", applies: isGetForm},
+		{tag: "img", attr: "srcset", style: linkStyleSrcset},
+		{tag: "source", attr: "srcset", style: linkStyleSrcset},
+		{tag: "meta", attr: "content", style: linkStyleRefresh, applies: isRefreshMeta},
+	} {
+		registerLinkRule(rule)
+	}
+}
+
+func registerLinkRule(rule linkRule) {
+	linkRules[rule.tag] = append(linkRules[rule.tag], rule)
+}
+
+func getAttr(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func isRefreshMeta(n *html.Node) bool {
+	httpEquiv, _ := getAttr(n, "http-equiv")
+	return strings.EqualFold(strings.TrimSpace(httpEquiv), "refresh")
+}
+
+// POST forms would need a body to give us anything meaningful
+func isGetForm(n *html.Node) bool {
+	method, _ := getAttr(n, "method")
+	method = strings.TrimSpace(method)
+	return len(method) == 0 || strings.EqualFold(method, http.MethodGet)
+}
+
+// parseLinks gets the link(s) out of the attribute value
+func (style linkStyle) parseLinks(value string) []string {
+	switch style {
+	case linkStyleSrcset:
+		// "image-1x.png 1x, image-2x.png 2x"; URLs can have commas too, but
+		// let's not be too pedantic here
+		var links []string
+		for _, candidate := range strings.Split(value, ",") {
+			fields := strings.Fields(candidate)
+			if len(fields) > 0 {
+				links = append(links, fields[0])
+			}
+		}
+		return links
+	case linkStyleRefresh:
+		// "5; url=https://example.com/", and url could be quoted
+		_, after, found := strings.Cut(value, ";")
+		if !found {
+			return nil
+		}
+		after = strings.TrimSpace(after)
+		if len(after) < 4 || !strings.EqualFold(after[:4], "url=") {
+			return nil
+		}
+		link := strings.Trim(strings.TrimSpace(after[4:]), `"'`)
+		if len(link) == 0 {
+			return nil
+		}
+		return []string{link}
+	case linkStyleSingle:
+		fallthrough
+	default:
+		value = strings.TrimSpace(value)
+		if len(value) == 0 {
+			return nil
+		}
+		return []string{value}
+	}
+}
+
+// rewriteLinks is a counterpart of parseLinks — it replaces the link(s) in
+// the attribute value with whatever rewrite returns, keeping the rest intact
+func (style linkStyle) rewriteLinks(value string, rewrite func(string) string) string {
+	switch style {
+	case linkStyleSrcset:
+		candidates := strings.Split(value, ",")
+		for i, candidate := range candidates {
+			fields := strings.Fields(candidate)
+			if len(fields) > 0 {
+				fields[0] = rewrite(fields[0])
+				candidates[i] = strings.Join(fields, " ")
+			}
+		}
+		return strings.Join(candidates, ", ")
+	case linkStyleRefresh:
+		links := style.parseLinks(value)
+		if len(links) == 0 {
+			return value
+		}
+		delay, _, _ := strings.Cut(value, ";")
+		return delay + "; url=" + rewrite(links[0])
+	case linkStyleSingle:
+		fallthrough
+	default:
+		if len(strings.TrimSpace(value)) == 0 {
+			return value
+		}
+		return rewrite(strings.TrimSpace(value))
+	}
+}
+
+// extractHTMLLinks walks the document and returns the links found (not yet
+// resolved), and the base URL they should be resolved against — that is the
+// document URL, unless the document has a <base href>
+func extractHTMLLinks(doc *html.Node, docURL *url.URL) (links []string, base *url.URL) {
+	base = docURL
+	baseIsSet := false
+
+	// https://pkg.go.dev/golang.org/x/net/html#example-Parse
+	var parseNode func(*html.Node)
+	parseNode = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			// only the first <base> counts, and it is relative to the document
+			if n.Data == "base" && !baseIsSet {
+				if href, ok := getAttr(n, "href"); ok {
+					if baseObject, err := url.Parse(strings.TrimSpace(href)); err == nil {
+						base, baseIsSet = docURL.ResolveReference(baseObject), true
+					}
+				}
+			}
+
+			for _, rule := range linkRules[n.Data] {
+				if rule.applies != nil && !rule.applies(n) {
+					continue
+				}
+				if value, ok := getAttr(n, rule.attr); ok {
+					links = append(links, rule.style.parseLinks(value)...)
+				}
+			}
+
+			// inline styles can have links too
+			if style, ok := getAttr(n, "style"); ok {
+				links = append(links, extractCSSLinks(style)...)
+			}
+			if n.Data == "style" {
+				for child := n.FirstChild; child != nil; child = child.NextSibling {
+					if child.Type == html.TextNode {
+						links = append(links, extractCSSLinks(child.Data)...)
+					}
+				}
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			parseNode(child)
+		}
+	}
+	parseNode(doc)
+
+	return links, base
+}
+
+// extractHeaderLinks returns the links from the Link response headers, like
+// `Link: </style.css>; rel=preload; as=style, </next>; rel=next`
+func extractHeaderLinks(header http.Header) []string {
+	var links []string
+	for _, value := range header.Values("Link") {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if !strings.HasPrefix(part, "<") {
+				continue
+			}
+			if end := strings.IndexByte(part, '>'); end > 1 {
+				links = append(links, part[1:end])
+			}
+		}
+	}
+
+	return links
+}
+
+// findCanonical returns the canonical URL the document declares, either with
+// <link rel="canonical"> (resolved against base), or with the Link header
+// (resolved against the document URL); nil if there is none
+func findCanonical(doc *html.Node, base *url.URL, header http.Header, docURL *url.URL) *url.URL {
+	var canonical *url.URL
+	var findNode func(*html.Node)
+	findNode = func(n *html.Node) {
+		if canonical != nil {
+			return
+		}
+		if n.Type == html.ElementNode && n.Data == "link" {
+			rel, _ := getAttr(n, "rel")
+			href, ok := getAttr(n, "href")
+			if ok && hasRelToken(rel, "canonical") {
+				if hrefObject, err := url.Parse(strings.TrimSpace(href)); err == nil {
+					canonical = base.ResolveReference(hrefObject)
+					return
+				}
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			findNode(child)
+		}
+	}
+	if doc != nil {
+		findNode(doc)
+	}
+	if canonical != nil {
+		return canonical
+	}
+
+	for _, value := range header.Values("Link") {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			end := strings.IndexByte(part, '>')
+			if !strings.HasPrefix(part, "<") || end < 2 {
+				continue
+			}
+			for _, param := range strings.Split(part[end+1:], ";") {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(name, "rel") && hasRelToken(strings.Trim(value, `"`), "canonical") {
+					if hrefObject, err := url.Parse(part[1:end]); err == nil {
+						return docURL.ResolveReference(hrefObject)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// rel is a space-separated list of tokens
+func hasRelToken(rel, token string) bool {
+	for _, field := range strings.Fields(rel) {
+		if strings.EqualFold(field, token) {
+			return true
+		}
+	}
+	return false
+}
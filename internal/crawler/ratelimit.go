@@ -0,0 +1,178 @@
+package crawler
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+// politeness: all the workers share a limiter per host, which decides when the
+// next request to that host can be made. so the number of workers controls how
+// many documents we can process in parallel, and the limiter controls the load
+// we put on the site.
+//
+// limiter has two knobs — the interval between the requests (from --rps and
+// robots.txt Crawl-delay), and the number of concurrent connections. also, if
+// the site starts to respond slower, or asks us to back off with 429/503, the
+// interval grows, and then it slowly returns back to normal.
+
+type hostLimiter struct {
+	mu sync.Mutex
+	// the interval never gets lower than this
+	minInterval time.Duration
+	interval    time.Duration
+	next        time.Time
+	// it is a semaphore
+	connections chan struct{}
+
+	latency         time.Duration
+	fastestLatency  time.Duration
+	lastSlowdownAt  time.Time
+	observedLatency bool
+}
+
+const (
+	// how much the latest response latency affects the average one
+	latencySmoothing = 0.2
+	// if the average latency becomes that many times worse than the best we
+	// have seen, we consider the site to be struggling
+	latencyDegradation = 3
+	// latencies below that are fine no matter what
+	latencyTolerable = 500 * time.Millisecond
+	// when --rps is 0, we still need something to multiply when slowing down
+	adaptiveMinInterval = 100 * time.Millisecond
+	adaptiveMaxInterval = time.Minute
+)
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*hostLimiter{}
+)
+
+// limiterFor returns the limiter of the host of a given URL, creating it on
+// the first call
+func limiterFor(urlObject *url.URL) *hostLimiter {
+	runtimeSettings := settings.Get()
+	key := robotsKey(urlObject)
+
+	limitersMu.Lock()
+	limiter, ok := limiters[key]
+	limitersMu.Unlock()
+	if ok {
+		return limiter
+	}
+
+	var minInterval time.Duration
+	if rps := runtimeSettings.RequestsPerSecond(); rps > 0 {
+		minInterval = time.Duration(float64(time.Second) / rps)
+	}
+	// that can take a while (robots.txt is fetched on the first call), so it
+	// is done without holding the lock, or all the hosts would wait for it
+	if !runtimeSettings.IgnoreRobots() {
+		if crawlDelay := robotsFor(urlObject).crawlDelay; crawlDelay > minInterval {
+			minInterval = crawlDelay
+		}
+	}
+
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	// someone could have made it while we were waiting for robots.txt
+	if limiter, ok := limiters[key]; ok {
+		return limiter
+	}
+	limiter = &hostLimiter{
+		minInterval: minInterval,
+		interval:    minInterval,
+		connections: make(chan struct{}, runtimeSettings.MaxConnectionsPerHost()),
+	}
+	limiters[key] = limiter
+
+	return limiter
+}
+
+// acquire blocks until we can make a request to the host. Caller must call
+// release when the request (body included) is done.
+// Every caller reserves its own time slot, so with N workers waiting and an
+// interval of D, the last one will wait for N*D.
+func (hl *hostLimiter) acquire(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case hl.connections <- struct{}{}:
+	}
+
+	hl.mu.Lock()
+	now := time.Now()
+	slot := hl.next
+	if slot.Before(now) {
+		slot = now
+	}
+	hl.next = slot.Add(hl.interval)
+	hl.mu.Unlock()
+
+	timer := time.NewTimer(slot.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		hl.release()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (hl *hostLimiter) release() {
+	<-hl.connections
+}
+
+// observe adjusts the interval based on how the site responded to us
+func (hl *hostLimiter) observe(latency time.Duration, statusCode int) {
+	if !settings.Get().AdaptiveThrottling() {
+		return
+	}
+	logger := settings.Get().Logger()
+
+	hl.mu.Lock()
+	defer hl.mu.Unlock()
+
+	if hl.observedLatency {
+		hl.latency = time.Duration(latencySmoothing*float64(latency) + (1-latencySmoothing)*float64(hl.latency))
+	} else {
+		hl.latency, hl.observedLatency = latency, true
+	}
+	if hl.fastestLatency == 0 || hl.latency < hl.fastestLatency {
+		hl.fastestLatency = hl.latency
+	}
+
+	askedToSlowDown := statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+	struggling := hl.latency > latencyTolerable && hl.latency > latencyDegradation*hl.fastestLatency
+
+	switch {
+	case askedToSlowDown || struggling:
+		// all the in-flight requests will report the same trouble at about the
+		// same time, so let's not react to each of them
+		if time.Since(hl.lastSlowdownAt) < hl.interval+hl.latency {
+			return
+		}
+		hl.lastSlowdownAt = time.Now()
+		hl.interval *= 2
+		if hl.interval < adaptiveMinInterval {
+			hl.interval = adaptiveMinInterval
+		}
+		if hl.interval > adaptiveMaxInterval {
+			hl.interval = adaptiveMaxInterval
+		}
+		logger.Warn().Int("statusCode", statusCode).Dur("latency", hl.latency).Dur("interval", hl.interval).Msg("site seems to struggle, slowing down")
+	case hl.interval > hl.minInterval:
+		// multiplicative increase, and a gentle decrease
+		hl.interval -= hl.interval / 20
+		if hl.interval < hl.minInterval || hl.interval < adaptiveMinInterval {
+			hl.interval = hl.minInterval
+		}
+	}
+}
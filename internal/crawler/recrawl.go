@@ -0,0 +1,102 @@
+package crawler
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/skaurus/ta-site-crawler/internal/queue"
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+// recrawl support: with --recrawl, the processed urls are queued again (see
+// queue.Init), and we ask the site if the documents have changed since we got
+// them, using the validators saved in the metadata (ETag and Last-Modified).
+// the documents that sitemaps say have not changed are not even asked for.
+
+// RecrawlReport counts what happened to the documents during this run
+type RecrawlReport struct {
+	Changed     uint32
+	Unchanged   uint32
+	Disappeared uint32
+	// those we did not have before
+	New uint32
+}
+
+var recrawlReport RecrawlReport
+
+func GetRecrawlReport() RecrawlReport {
+	return RecrawlReport{
+		Changed:     atomic.LoadUint32(&recrawlReport.Changed),
+		Unchanged:   atomic.LoadUint32(&recrawlReport.Unchanged),
+		Disappeared: atomic.LoadUint32(&recrawlReport.Disappeared),
+		New:         atomic.LoadUint32(&recrawlReport.New),
+	}
+}
+
+// haveStoredDocument tells if the document from the previous pass is still
+// there. with WARC-only output there is no document to keep, so it is not.
+func haveStoredDocument(previous queue.Metadata) bool {
+	if len(previous.Path) == 0 {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(settings.Get().OutputDir(), settings.CrawlingDir, filepath.FromSlash(previous.Path)))
+
+	return err == nil
+}
+
+// unchangedBySitemap tells if a sitemap says the document has not changed
+// since the previous pass got it, so there is no need to even ask the site.
+// sitemaps are not always right about that, but then it is the site that is
+// wrong, and we will get the document on the pass after it is fixed.
+func unchangedBySitemap(q queue.Queue, urlString string, previous queue.Metadata) (bool, error) {
+	if previous.FetchedAt.IsZero() || !haveStoredDocument(previous) {
+		return false, nil
+	}
+	lastmod, err := q.Lastmod(urlString)
+	if err != nil || lastmod.IsZero() {
+		return false, err
+	}
+
+	return lastmod.Before(previous.FetchedAt), nil
+}
+
+// setConditionalHeaders makes the request conditional, if we have the document
+// from the previous pass and its validators. Returns true if it did.
+func setConditionalHeaders(req *http.Request, previous queue.Metadata) bool {
+	if !haveStoredDocument(previous) {
+		return false
+	}
+
+	conditional := false
+	if len(previous.ETag) > 0 {
+		req.Header.Set("If-None-Match", previous.ETag)
+		conditional = true
+	}
+	if len(previous.LastModified) > 0 {
+		req.Header.Set("If-Modified-Since", previous.LastModified)
+		conditional = true
+	}
+
+	return conditional
+}
+
+// hadDocument tells if we successfully downloaded the document before; old
+// records have just the path
+func hadDocument(previous queue.Metadata, known bool) bool {
+	return known && (len(previous.Path) > 0 || (previous.StatusCode >= 200 && previous.StatusCode < 300))
+}
+
+// countRecrawled sorts a freshly downloaded document into changed, unchanged,
+// or new; not all sites support conditional requests, so we compare the bodies
+func countRecrawled(previous queue.Metadata, known bool, digest string) {
+	switch {
+	case !hadDocument(previous, known):
+		atomic.AddUint32(&recrawlReport.New, 1)
+	case previous.Digest == digest:
+		atomic.AddUint32(&recrawlReport.Unchanged, 1)
+	default:
+		atomic.AddUint32(&recrawlReport.Changed, 1)
+	}
+}
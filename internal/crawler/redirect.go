@@ -0,0 +1,115 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/skaurus/ta-site-crawler/internal/queue"
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+	"github.com/skaurus/ta-site-crawler/internal/utils"
+)
+
+// http.Client follows redirects on its own, and would happily take us to
+// another site, or to a page we have already downloaded. so every hop is checked
+// against the same rules the found links go through, and the hops are kept to
+// record them in the metadata. a redirect we do not follow is not an error:
+// we get the 3xx response itself, and the task is done.
+
+var (
+	errTooManyRedirects = errors.New("too many redirects")
+)
+
+// robots.txt and sitemaps are not documents we crawl, so --max-redirects is
+// not for them; a robots.txt moved from http to https is common, and giving
+// up on it would make us think the whole site is disallowed
+const auxiliaryMaxRedirects = 10
+
+type redirectChainKey struct{}
+
+// redirectChain is attached to the context of a crawl request (robots.txt and
+// sitemaps requests go without it, and their redirects are just counted, see
+// auxiliaryMaxRedirects)
+type redirectChain struct {
+	q queue.Queue
+	// normalized URL of the task
+	from string
+	hops []queue.Redirect
+	// normalized URL of the redirect target we refused to go to, and why
+	notFollowed       string
+	notFollowedReason string
+}
+
+func withRedirectChain(ctx context.Context, chain *redirectChain) context.Context {
+	return context.WithValue(ctx, redirectChainKey{}, chain)
+}
+
+// checkRedirect is http.Client.CheckRedirect; via holds the requests made so
+// far, oldest first, and req.Response is the redirect that led to req
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	chain, _ := req.Context().Value(redirectChainKey{}).(*redirectChain)
+	if chain == nil {
+		if len(via) > auxiliaryMaxRedirects {
+			return fmt.Errorf("%w: stopped after %d", errTooManyRedirects, auxiliaryMaxRedirects)
+		}
+		return nil
+	}
+	maxRedirects := int(settings.Get().MaxRedirects())
+
+	chain.hops = append(chain.hops, queue.Redirect{
+		URL:        via[len(via)-1].URL.String(),
+		StatusCode: req.Response.StatusCode,
+	})
+
+	targetUrlObject, err := utils.NormalizeUrlObject(req.URL)
+	if err != nil {
+		return err
+	}
+	target := targetUrlObject.String()
+	if maxRedirects == 0 {
+		chain.notFollowed, chain.notFollowedReason = target, "redirects are not followed"
+		return http.ErrUseLastResponse
+	}
+	if len(via) > maxRedirects {
+		return fmt.Errorf("%w: stopped after %d", errTooManyRedirects, maxRedirects)
+	}
+	if reason := chain.refusal(targetUrlObject); len(reason) > 0 {
+		chain.notFollowed, chain.notFollowedReason = target, reason
+		return http.ErrUseLastResponse
+	}
+
+	return nil
+}
+
+// refusal tells why we should not go to the redirect target, if there is a reason
+func (chain *redirectChain) refusal(targetUrlObject *url.URL) string {
+	if !settings.Get().HostPolicy().Allows(targetUrlObject) {
+		return "host is not allowed by the host policy"
+	}
+	if _, err := utils.UrlToHost(targetUrlObject); err != nil {
+		return "invalid host"
+	}
+	if decision := settings.Get().Scope().Check(targetUrlObject); !decision.InScope {
+		return decision.String()
+	}
+	if !robotsAllowed(targetUrlObject) {
+		return "disallowed by robots.txt"
+	}
+
+	target := targetUrlObject.String()
+	// some sites redirect to the same page to set a cookie, and the task
+	// itself is in progress, of course
+	if target == chain.from {
+		return ""
+	}
+	if processed, err := chain.q.IsProcessed(target); err == nil && processed {
+		return "already processed"
+	}
+	if inProgress, err := chain.q.IsInProgress(target); err == nil && inProgress {
+		return "being processed by another worker"
+	}
+
+	return ""
+}
@@ -0,0 +1,69 @@
+package crawler
+
+import (
+	"math/rand"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+// isRetryableStatus tells if it makes sense to try again after getting a given
+// status code; by default those are 429 and some of 5xx, see --retry-statuses
+func isRetryableStatus(statusCode int) bool {
+	return slices.Contains(settings.Get().RetryStatuses(), statusCode)
+}
+
+// parseRetryAfter understands both forms of the Retry-After header — number
+// of seconds, and an HTTP date. Returns zero if there is no (valid) header.
+func parseRetryAfter(header http.Header) time.Duration {
+	value := strings.TrimSpace(header.Get("Retry-After"))
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(at); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
+}
+
+// nextRetryAt decides when a task that failed for the `attempts`-th time should
+// be tried again; zero time means we should give up on it.
+// The delay is exponential (base, 2*base, 4*base... up to the max), and
+// "equal jitter" is applied to it, so that the tasks failed at the same time
+// (site went down for a minute) do not come back at the same time as well.
+// If the server told us when to come back (retryAfter), we wait at least that.
+func nextRetryAt(attempts int, retryAfter time.Duration) time.Time {
+	runtimeSettings := settings.Get()
+	if attempts >= int(runtimeSettings.RetryMaxAttempts()) {
+		return time.Time{}
+	}
+
+	delay := runtimeSettings.RetryBaseDelay()
+	for i := 1; i < attempts && delay < runtimeSettings.RetryMaxDelay(); i++ {
+		delay *= 2
+	}
+	if delay > runtimeSettings.RetryMaxDelay() {
+		delay = runtimeSettings.RetryMaxDelay()
+	}
+	if delay > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)) //nolint:gosec
+	}
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+
+	return time.Now().Add(delay)
+}
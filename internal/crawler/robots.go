@@ -0,0 +1,326 @@
+package crawler
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+// robots.txt handling, as described in https://www.rfc-editor.org/rfc/rfc9309
+// there are libraries for that, but the format is simple enough, and I'd rather
+// not add a dependency for a hundred lines of code
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+type robotsRules struct {
+	rules []robotsRule
+	// zero means there was no Crawl-delay for us
+	crawlDelay time.Duration
+	// when robots.txt is unreachable (5xx, network errors), RFC says we must
+	// assume that everything is disallowed; that is until we fetch it again
+	// (see robotsUnreachableTTL)
+	disallowAll bool
+	// Sitemap lines are not a part of any group, so we keep all of them
+	sitemaps []string
+}
+
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+const (
+	// RFC 9309 says crawlers must parse at least 500 KiB
+	robotsMaxSize = 500 * 1024
+	// unreachable robots.txt is most likely a temporary problem, so after this
+	// long we fetch it again, instead of skipping the host for the whole crawl
+	robotsUnreachableTTL = time.Minute
+)
+
+// robotsEntry is fetched once, by whoever needs it first
+type robotsEntry struct {
+	once  sync.Once
+	rules *robotsRules
+	// zero means the entry does not expire; guarded by robotsMu, as it is
+	// checked before the fetch is done
+	expiresAt time.Time
+}
+
+// robotsDecision is what robots.txt says about a URL
+type robotsDecision int
+
+const (
+	robotsAllow robotsDecision = iota
+	robotsDisallow
+	// robots.txt can't be fetched right now, so nothing is allowed, but that
+	// can change (see robotsUnreachableTTL)
+	robotsUnreachable
+)
+
+var (
+	robotsMu    sync.Mutex
+	robotsCache = map[string]*robotsEntry{}
+)
+
+// robotsKey returns the key robots.txt is cached with; per RFC, robots.txt
+// applies to a scheme + authority combination
+func robotsKey(urlObject *url.URL) string {
+	return strings.ToLower(urlObject.Scheme + "://" + urlObject.Host)
+}
+
+// robotsAgentToken extracts the product token from our User-Agent, e.g.
+// "ta-site-crawler" from "ta-site-crawler/1.0 (+https://example.com)"
+func robotsAgentToken() string {
+	token := settings.Get().UserAgent()
+	if i := strings.IndexAny(token, "/ "); i >= 0 {
+		token = token[:i]
+	}
+	return strings.ToLower(token)
+}
+
+// robotsFor returns robots.txt rules for the host of a given URL, fetching
+// them on the first call. The workers that need the same host wait for that
+// fetch, so there is no stampede when all of them start at the same time; the
+// global mutex is not held during the fetch, so the other hosts do not wait.
+func robotsFor(urlObject *url.URL) *robotsRules {
+	key := robotsKey(urlObject)
+
+	robotsMu.Lock()
+	entry, ok := robotsCache[key]
+	if !ok || (!entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt)) {
+		entry = &robotsEntry{}
+		robotsCache[key] = entry
+	}
+	robotsMu.Unlock()
+
+	entry.once.Do(func() {
+		entry.rules = fetchRobots(key)
+		if entry.rules.disallowAll {
+			robotsMu.Lock()
+			entry.expiresAt = time.Now().Add(robotsUnreachableTTL)
+			robotsMu.Unlock()
+		}
+	})
+
+	return entry.rules
+}
+
+func fetchRobots(key string) *robotsRules {
+	logger := settings.Get().Logger().With().Str("robots", key+"/robots.txt").Logger()
+
+	req, err := newRequest(context.Background(), key+"/robots.txt")
+	if err != nil {
+		logger.Error().Err(err).Msg("can't create robots.txt request")
+		return &robotsRules{disallowAll: true}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logger.Warn().Err(err).Msg("robots.txt is unreachable, assuming everything is disallowed")
+		return &robotsRules{disallowAll: true}
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		// RFC: "unavailable" robots.txt means there are no restrictions
+		logger.Info().Int("statusCode", resp.StatusCode).Msg("robots.txt is unavailable, assuming everything is allowed")
+		return &robotsRules{}
+	default:
+		logger.Warn().Int("statusCode", resp.StatusCode).Msg("robots.txt is unreachable, assuming everything is disallowed")
+		return &robotsRules{disallowAll: true}
+	}
+
+	rules := parseRobots(io.LimitReader(resp.Body, robotsMaxSize), robotsAgentToken())
+	logger.Info().Int("rules", len(rules.rules)).Dur("crawlDelay", rules.crawlDelay).Msg("got robots.txt")
+
+	return rules
+}
+
+// parseRobots parses robots.txt and returns the rules for a given agent token.
+// If there are groups for our token, we use them (all of them, merged), and
+// fall back to the "*" groups otherwise.
+func parseRobots(r io.Reader, agentToken string) *robotsRules {
+	var (
+		groups   []*robotsGroup
+		current  *robotsGroup
+		sitemaps []string
+		// consecutive user-agent lines belong to the same group
+		lastWasAgent bool
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if current == nil || !lastWasAgent {
+				current = &robotsGroup{}
+				groups = append(groups, current)
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+			lastWasAgent = true
+			continue
+		case "allow", "disallow":
+			// rules outside of any group are ignored, as well as empty ones —
+			// "Disallow:" with nothing means "allow everything"
+			if current != nil && len(value) > 0 {
+				current.rules = append(current.rules, robotsRule{allow: key == "allow", pattern: value})
+			}
+		case "sitemap":
+			// value has a colon itself, but strings.Cut splits on the first one
+			if len(value) > 0 {
+				sitemaps = append(sitemaps, value)
+			}
+		case "crawl-delay":
+			// not in the RFC, but widely used
+			if current != nil {
+				if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+					current.crawlDelay = time.Duration(seconds * float64(time.Second))
+				}
+			}
+		}
+		lastWasAgent = false
+	}
+
+	var ours, wildcard []*robotsGroup
+	for _, group := range groups {
+		for _, agent := range group.agents {
+			if agent == agentToken {
+				ours = append(ours, group)
+				break
+			}
+			if agent == "*" {
+				wildcard = append(wildcard, group)
+				break
+			}
+		}
+	}
+	if len(ours) == 0 {
+		ours = wildcard
+	}
+
+	rules := &robotsRules{sitemaps: sitemaps}
+	for _, group := range ours {
+		rules.rules = append(rules.rules, group.rules...)
+		if group.crawlDelay > rules.crawlDelay {
+			rules.crawlDelay = group.crawlDelay
+		}
+	}
+
+	return rules
+}
+
+// isAllowed applies the rules to a given URL. The most specific (longest)
+// matching rule wins, and if an allow and a disallow rules are equally
+// specific — allow wins.
+func (rr *robotsRules) isAllowed(urlObject *url.URL) bool {
+	path := urlObject.EscapedPath()
+	if len(path) == 0 {
+		path = "/"
+	}
+	if path == "/robots.txt" {
+		return true
+	}
+	if rr.disallowAll {
+		return false
+	}
+	if len(urlObject.RawQuery) > 0 {
+		path = path + "?" + urlObject.RawQuery
+	}
+
+	allowed, matchedLen := true, -1
+	for _, rule := range rr.rules {
+		if !robotsPatternMatches(rule.pattern, path) {
+			continue
+		}
+		if len(rule.pattern) > matchedLen || (len(rule.pattern) == matchedLen && rule.allow) {
+			allowed, matchedLen = rule.allow, len(rule.pattern)
+		}
+	}
+
+	return allowed
+}
+
+// robotsPatternMatches supports "*" (any sequence of characters) and "$" (end
+// of the path) special characters, as required by the RFC
+func robotsPatternMatches(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+
+	parts := strings.Split(pattern, "*")
+	// first part must be a prefix, as all robots patterns start at the path start
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	pos := len(parts[0])
+	for i, part := range parts[1:] {
+		isLast := i == len(parts)-2
+		if isLast && anchored {
+			return strings.HasSuffix(path[pos:], part)
+		}
+		idx := strings.Index(path[pos:], part)
+		if idx < 0 {
+			return false
+		}
+		pos += idx + len(part)
+	}
+
+	return !anchored || pos == len(path)
+}
+
+// robotsCheck tells whether we can fetch a given URL, and if not — whether
+// that is because of robots.txt rules, or because we could not get them
+func robotsCheck(urlObject *url.URL) robotsDecision {
+	if settings.Get().IgnoreRobots() {
+		return robotsAllow
+	}
+	rules := robotsFor(urlObject)
+	if rules.isAllowed(urlObject) {
+		return robotsAllow
+	}
+	if rules.disallowAll {
+		return robotsUnreachable
+	}
+	return robotsDisallow
+}
+
+// robotsAllowed tells whether we can fetch a given URL
+func robotsAllowed(urlObject *url.URL) bool {
+	return robotsCheck(urlObject) == robotsAllow
+}
+
+// newRequest creates a GET request with our User-Agent
+func newRequest(ctx context.Context, urlString string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlString, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", settings.Get().UserAgent())
+
+	return req, nil
+}
@@ -0,0 +1,245 @@
+package crawler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skaurus/ta-site-crawler/internal/queue"
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+	"github.com/skaurus/ta-site-crawler/internal/utils"
+)
+
+// sitemaps support, see https://www.sitemaps.org/protocol.html
+
+type sitemapEntry struct {
+	Loc     string `xml:"loc"`
+	Lastmod string `xml:"lastmod"`
+}
+
+const (
+	// protocol limits uncompressed sitemap size to 50 MiB
+	sitemapMaxSize = 50 * 1024 * 1024
+	// protocol does not allow index files to reference other index files, but
+	// sites do all sorts of things, so let's just not go too deep
+	sitemapMaxDepth = 5
+)
+
+var (
+	// lastmod uses W3C Datetime format, which allows omitting parts of the
+	// date-time from the right
+	sitemapLastmodLayouts = []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04Z07:00",
+		"2006-01-02",
+		"2006-01",
+		"2006",
+	}
+)
+
+// DiscoverSitemaps seeds the queue with the pages listed in sitemaps of the
+// starting host — those are taken from robots.txt Sitemap: lines, plus the
+// conventional /sitemap.xml. That helps with pages that are not linked from
+// anywhere. Lastmod values are saved to the queue, so that recrawl can skip
+// the documents that have not changed.
+func DiscoverSitemaps(ctx context.Context, q queue.Queue) error {
+	runtimeSettings := settings.Get()
+	logger := runtimeSettings.Logger().With().Str("stage", "sitemaps").Logger()
+
+	startURL := runtimeSettings.URL()
+
+	// robots.txt is fetched even with --ignore-robots, we just do not apply
+	// its rules in that case
+	sitemapURLs := robotsFor(startURL).sitemaps
+	defaultSitemap := startURL.ResolveReference(&url.URL{Path: "/sitemap.xml"}).String()
+	sitemapURLs = append(sitemapURLs, defaultSitemap)
+
+	visited := make(map[string]bool)
+	var queued, seen int
+	var walk func(sitemapURL string, depth int)
+	walk = func(sitemapURL string, depth int) {
+		if visited[sitemapURL] || depth > sitemapMaxDepth || ctx.Err() != nil {
+			return
+		}
+		visited[sitemapURL] = true
+
+		pages, children, err := fetchSitemap(ctx, sitemapURL)
+		if err != nil && len(pages) == 0 && len(children) == 0 {
+			// most sites do not have /sitemap.xml at all, nothing to worry about
+			logger.Info().Err(err).Str("sitemap", sitemapURL).Msg("can't get sitemap")
+			return
+		}
+		if err != nil {
+			// a broken (or cut by the size limit) sitemap still has some use
+			logger.Warn().Err(err).Str("sitemap", sitemapURL).Msg("sitemap is broken, using what we could parse")
+		}
+		logger.Info().Str("sitemap", sitemapURL).Int("pages", len(pages)).Int("sitemaps", len(children)).Msg("got sitemap")
+
+		tasks := make([]queue.Task, 0, len(pages))
+		lastmods := make(map[string]time.Time)
+		for _, page := range pages {
+			seen++
+			pageUrlObject, err := url.Parse(page.Loc)
+			if err != nil || !pageUrlObject.IsAbs() {
+				logger.Debug().Str("loc", page.Loc).Msg("sitemap has a bad url")
+				continue
+			}
+			pageUrlObject, err = utils.NormalizeUrlObject(pageUrlObject)
+			if err != nil {
+				logger.Debug().Err(err).Str("loc", page.Loc).Msg("can't parse normalized version of sitemap url")
+				continue
+			}
+
+			// the pages from sitemaps are one hop away from the starting url,
+			// as if it linked to them
+			if followable(&logger, pageUrlObject) {
+				tasks = append(tasks, queue.Task{URL: pageUrlObject.String(), Depth: 1, Referrer: sitemapURL})
+			}
+
+			if lastmod, ok := parseSitemapLastmod(page.Lastmod); ok {
+				lastmods[pageUrlObject.String()] = lastmod
+			}
+		}
+		if err := q.SetLastmods(lastmods); err != nil {
+			logger.Error().Err(err).Str("sitemap", sitemapURL).Msg("can't save lastmods")
+		}
+
+		for _, outcome := range enqueueFoundURLs(q, &logger, tasks) {
+			if outcome == queue.OutcomeQueued {
+				queued++
+			}
+		}
+
+		for _, child := range children {
+			// an index could send us anywhere otherwise
+			if !sitemapAllowed(child.Loc) {
+				logger.Debug().Str("sitemap", sitemapURL).Str("child", child.Loc).Msg("child sitemap is out of scope")
+				continue
+			}
+			walk(child.Loc, depth+1)
+		}
+	}
+	for _, sitemapURL := range sitemapURLs {
+		walk(sitemapURL, 0)
+	}
+
+	logger.Info().Int("seen", seen).Int("queued", queued).Msg("sitemaps are processed")
+
+	return ctx.Err()
+}
+
+// sitemapAllowed tells if a sitemap found in a sitemap index is worth
+// fetching: it must be on a host we crawl, and in scope
+func sitemapAllowed(sitemapURL string) bool {
+	urlObject, err := url.Parse(sitemapURL)
+	if err != nil || !urlObject.IsAbs() {
+		return false
+	}
+	if !settings.Get().HostPolicy().Allows(urlObject) {
+		return false
+	}
+
+	return settings.Get().Scope().Check(urlObject).InScope
+}
+
+// fetchSitemap downloads and parses a sitemap; it returns pages for regular
+// sitemaps, and child sitemaps for sitemap index files. Both gzipped and plain
+// sitemaps are supported. If parsing fails halfway, what was parsed before
+// that is returned along with the error.
+func fetchSitemap(ctx context.Context, sitemapURL string) (pages, children []sitemapEntry, err error) {
+	urlObject, err := url.Parse(sitemapURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !robotsAllowed(urlObject) {
+		return nil, nil, errors.New("sitemap is disallowed by robots.txt")
+	}
+	limiter := limiterFor(urlObject)
+	if err := limiter.acquire(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer limiter.release()
+
+	req, err := newRequest(ctx, sitemapURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	requestStartedAt := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	limiter.observe(time.Since(requestStartedAt), resp.StatusCode)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300; !statusOK {
+		return nil, nil, fmt.Errorf("bad http status code %d", resp.StatusCode)
+	}
+
+	// .xml.gz files are usually served as application/gzip or something like
+	// that, not with Content-Encoding: gzip, so http.Client does not unpack
+	// them for us. checking the magic bytes is the most reliable way to tell
+	var body io.Reader = bufio.NewReader(resp.Body)
+	magic, _ := body.(*bufio.Reader).Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer func() {
+			_ = gzipReader.Close()
+		}()
+		body = gzipReader
+	}
+
+	decoder := xml.NewDecoder(io.LimitReader(body, sitemapMaxSize))
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return pages, children, err
+		}
+
+		startElement, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch startElement.Name.Local {
+		case "url", "sitemap":
+			var entry sitemapEntry
+			if err := decoder.DecodeElement(&entry, &startElement); err != nil {
+				return pages, children, err
+			}
+			entry.Loc, entry.Lastmod = strings.TrimSpace(entry.Loc), strings.TrimSpace(entry.Lastmod)
+			if len(entry.Loc) == 0 {
+				continue
+			}
+			if startElement.Name.Local == "url" {
+				pages = append(pages, entry)
+			} else {
+				children = append(children, entry)
+			}
+		}
+	}
+
+	return pages, children, nil
+}
+
+func parseSitemapLastmod(value string) (time.Time, bool) {
+	for _, layout := range sitemapLastmodLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package pidfile
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isAlive checks if a process exists by sending it a signal 0, which does
+// nothing except for the error checking. EPERM means the process exists, but
+// it belongs to someone else.
+func isAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package pidfile
+
+import (
+	"os"
+)
+
+// isAlive relies on the fact that on Windows os.FindProcess actually opens the
+// process, and fails if there is no such process
+func isAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = process.Release()
+
+	return true
+}
@@ -0,0 +1,136 @@
+package pidfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+// see docs/madr/003-allowing-only-single-instance-per-domain.md for why we
+// use a pid file and not a lock file
+
+// ErrAlreadyRunning means that there is a live process holding the pid file
+type ErrAlreadyRunning struct {
+	PID  int
+	Path string
+}
+
+func (e *ErrAlreadyRunning) Error() string {
+	return fmt.Sprintf(
+		"another crawler instance (pid %d) is already working with this folder; if you are sure that is not the case, remove %s",
+		e.PID, e.Path,
+	)
+}
+
+// Acquire creates a pid file with our pid at a given path. If the file already
+// exists, and the process mentioned there is alive, *ErrAlreadyRunning is
+// returned; if that process is gone, the file is considered stale and replaced.
+func Acquire(path string) error {
+	// second attempt is for the case when we removed a stale file, but someone
+	// else was quicker to create a new one
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, settings.FilePermissions)
+		if err == nil {
+			_, err = file.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+			closeErr := file.Close()
+			if err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				_ = os.Remove(path)
+				return fmt.Errorf("can't write pid file %s: %w", path, err)
+			}
+			return nil
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("can't create pid file %s: %w", path, err)
+		}
+
+		pid, err := read(path)
+		if err != nil {
+			// could be a half-written file of the process that has just started,
+			// but far more likely it is a garbage; let's not guess, and let the
+			// human decide
+			return fmt.Errorf("pid file %s exists, but can't be read (%v); remove it if no other crawler instance works with this folder", path, err)
+		}
+		// after a reboot (or in a container) our pid can easily be the same as
+		// the one of a previous run
+		if pid != os.Getpid() && isAlive(pid) {
+			return &ErrAlreadyRunning{PID: pid, Path: path}
+		}
+
+		if err := removeStale(path, pid); err != nil {
+			return err
+		}
+	}
+
+	return fmt.Errorf("can't create pid file %s: someone keeps creating it", path)
+}
+
+// removeStale removes the pid file of a given process that is gone. Other
+// instances starting at the same time could find that file stale as well; to
+// make sure only one of them removes it (and not the fresh one, created by
+// another of them), that is done by whoever creates a marker file for that pid
+// first. With the marker, the pid file is read once again, as someone could
+// have replaced it before that.
+func removeStale(path string, pid int) error {
+	marker := path + ".stale-" + strconv.Itoa(pid)
+	file, err := os.OpenFile(marker, os.O_WRONLY|os.O_CREATE|os.O_EXCL, settings.FilePermissions)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("another crawler instance is replacing stale pid file %s; if that is not the case, remove %s", path, marker)
+		}
+		return fmt.Errorf("can't create %s: %w", marker, err)
+	}
+	_ = file.Close()
+	defer func() {
+		_ = os.Remove(marker)
+	}()
+
+	current, err := read(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("pid file %s exists, but can't be read (%v); remove it if no other crawler instance works with this folder", path, err)
+	}
+	if current != pid {
+		return nil
+	}
+
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("can't remove stale pid file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Release removes the pid file, but only if it is ours
+func Release(path string) error {
+	pid, err := read(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if pid != os.Getpid() {
+		return fmt.Errorf("pid file %s belongs to another process (pid %d)", path, pid)
+	}
+
+	return os.Remove(path)
+}
+
+func read(path string) (int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
@@ -0,0 +1,119 @@
+package pidfile
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+// deadPID returns the pid of a process that has already exited
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	pid := cmd.Process.Pid
+	if isAlive(pid) {
+		t.Skipf("pid %d is taken again already", pid)
+	}
+
+	return pid
+}
+
+func writePID(t *testing.T, path string, pid int) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strconv.Itoa(pid)+"\n"), settings.FilePermissions); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crawler.pid")
+
+	if err := Acquire(path); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := read(path); err != nil || pid != os.Getpid() {
+		t.Errorf("pid file has %d, %v, expected our pid", pid, err)
+	}
+	if err := Release(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("pid file is not removed: %v", err)
+	}
+}
+
+func TestAcquireAlive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crawler.pid")
+	// the one that runs the tests is alive, for sure
+	writePID(t, path, os.Getppid())
+
+	var alreadyRunning *ErrAlreadyRunning
+	if err := Acquire(path); !errors.As(err, &alreadyRunning) || alreadyRunning.PID != os.Getppid() {
+		t.Fatalf("got %v, expected ErrAlreadyRunning", err)
+	}
+	if pid, err := read(path); err != nil || pid != os.Getppid() {
+		t.Errorf("pid file of a live process is changed: %d, %v", pid, err)
+	}
+	if err := Release(path); err == nil {
+		t.Error("pid file of another process is released")
+	}
+}
+
+func TestAcquireStale(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "crawler.pid")
+	stalePID := deadPID(t)
+	writePID(t, path, stalePID)
+
+	if err := Acquire(path); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := read(path); err != nil || pid != os.Getpid() {
+		t.Errorf("stale pid file is not replaced: %d, %v", pid, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("marker file is left behind: %v", entries)
+	}
+}
+
+// while another instance is replacing the stale file, we must not touch it
+func TestAcquireStaleBeingReplaced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crawler.pid")
+	stalePID := deadPID(t)
+	writePID(t, path, stalePID)
+	writePID(t, path+".stale-"+strconv.Itoa(stalePID), stalePID+1)
+
+	if err := Acquire(path); err == nil {
+		t.Fatal("stale pid file is replaced while another instance is at it")
+	}
+	if pid, err := read(path); err != nil || pid != stalePID {
+		t.Errorf("pid file is changed: %d, %v", pid, err)
+	}
+}
+
+// the stale file can be replaced by another instance after we found it stale,
+// but before we got to removing it
+func TestRemoveStaleReplaced(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crawler.pid")
+	stalePID := deadPID(t)
+	writePID(t, path, os.Getppid())
+
+	if err := removeStale(path, stalePID); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := read(path); err != nil || pid != os.Getppid() {
+		t.Errorf("fresh pid file is removed: %d, %v", pid, err)
+	}
+}
@@ -0,0 +1,104 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// the queue logic does not care where the data lives, as long as it has
+// buckets of key-value pairs, lists and sets, and transactions over all of
+// them (see MADR 004). backends provide that; they register themselves here,
+// and are picked by name with --queue-backend.
+
+var (
+	// ErrNotFound is returned by Tx.Get for a missing key
+	ErrNotFound = errors.New("not found")
+
+	errReadOnlyTx = errors.New("transaction is read-only")
+)
+
+// Entry is a key-value pair from a bucket
+type Entry struct {
+	Key   []byte
+	Value []byte
+}
+
+// Tx is a transaction. Missing buckets, lists and sets are just empty; lists
+// and sets live in buckets, under their keys. A transaction that returns an
+// error is rolled back.
+// Reads are not guaranteed to see the writes made earlier in the same
+// transaction (NutsDB's do not), so a transaction must not rely on that. The
+// writes, though, take effect in the order they are made: a delete of a key
+// put earlier in the same transaction does delete it.
+type Tx interface {
+	Get(bucket string, key []byte) (Entry, error)
+	// GetAll returns the entries ordered by key
+	GetAll(bucket string) ([]Entry, error)
+	Put(bucket string, key, value []byte) error
+	Delete(bucket string, key []byte) error
+
+	RPush(bucket string, key, value []byte) error
+	LPush(bucket string, key, value []byte) error
+	// LPop returns nil if the list is empty
+	LPop(bucket string, key []byte) ([]byte, error)
+	LSize(bucket string, key []byte) (int, error)
+	// LRange returns the whole list, head first
+	LRange(bucket string, key []byte) ([][]byte, error)
+
+	SAdd(bucket string, key, member []byte) error
+	SRem(bucket string, key, member []byte) error
+	SIsMember(bucket string, key, member []byte) (bool, error)
+	SMembers(bucket string, key []byte) ([][]byte, error)
+}
+
+// Store is where the queue keeps its data
+type Store interface {
+	// View runs a read-only transaction
+	View(func(tx Tx) error) error
+	Update(func(tx Tx) error) error
+	Close() error
+}
+
+// Backend opens (or creates) a store in a given folder
+type Backend struct {
+	Open func(dir string) (Store, error)
+	// data survives the restart, so the crawl can be resumed
+	Persistent bool
+}
+
+var backends = map[string]Backend{}
+
+// RegisterBackend makes a backend available by a given name
+func RegisterBackend(name string, backend Backend) {
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("queue backend %s is already registered", name))
+	}
+	backends[name] = backend
+}
+
+// Backends lists the names of the registered backends
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// OpenStore opens a store of a given backend in a given folder
+func OpenStore(name, dir string) (Store, error) {
+	backend, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown queue backend %q", name)
+	}
+
+	return backend.Open(dir)
+}
+
+// IsPersistent tells if a given backend keeps the data between the runs
+func IsPersistent(name string) bool {
+	return backends[name].Persistent
+}
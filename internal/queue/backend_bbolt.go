@@ -0,0 +1,265 @@
+package queue
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+// bbolt (the maintained fork of Bolt) is only a key-value store, which is why
+// it lost to NutsDB back then (see MADR 002). but lists and sets are easy to
+// build on top of its ordered keys: a list is a bucket with sequence numbers as
+// keys, and a set is a bucket with members as keys. and in return we get one
+// file, real ACID transactions, and a lot of production mileage.
+
+const (
+	BackendBbolt = "bbolt"
+
+	bboltFilename = "queue.bolt"
+)
+
+func init() {
+	RegisterBackend(BackendBbolt, Backend{Open: openBbolt, Persistent: true})
+}
+
+// list keys start in the middle of uint64, so there is room to grow both ways
+const bboltListMiddle uint64 = 1 << 63
+
+type bboltStore struct {
+	db *bbolt.DB
+}
+
+type bboltTx struct {
+	tx *bbolt.Tx
+}
+
+func openBbolt(dir string) (Store, error) {
+	db, err := bbolt.Open(
+		filepath.Join(dir, bboltFilename),
+		settings.FilePermissions,
+		// the file is locked while it is open; that should not happen (see
+		// MADR 003), but if it does, we'd better fail than hang
+		&bbolt.Options{Timeout: time.Second},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bboltStore{db: db}, nil
+}
+
+func (s *bboltStore) View(fn func(tx Tx) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		return fn(&bboltTx{tx: tx})
+	})
+}
+
+func (s *bboltStore) Update(fn func(tx Tx) error) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return fn(&bboltTx{tx: tx})
+	})
+}
+
+func (s *bboltStore) Close() error {
+	return s.db.Close()
+}
+
+func bboltKVName(bucket string) []byte {
+	return []byte("kv/" + bucket)
+}
+
+func bboltListName(bucket string, key []byte) []byte {
+	return []byte("list/" + bucket + "/" + string(key))
+}
+
+func bboltSetName(bucket string, key []byte) []byte {
+	return []byte("set/" + bucket + "/" + string(key))
+}
+
+// bucket returns a bbolt bucket; it is nil if there is no such bucket, and
+// create is false (or the transaction is read-only)
+func (t *bboltTx) bucket(name []byte, create bool) (*bbolt.Bucket, error) {
+	if !create || !t.tx.Writable() {
+		return t.tx.Bucket(name), nil
+	}
+
+	return t.tx.CreateBucketIfNotExists(name)
+}
+
+// values returned by bbolt are valid only during the transaction
+func clone(value []byte) []byte {
+	return append([]byte{}, value...)
+}
+
+func (t *bboltTx) Get(bucket string, key []byte) (Entry, error) {
+	b, err := t.bucket(bboltKVName(bucket), false)
+	if err != nil {
+		return Entry{}, err
+	}
+	if b == nil {
+		return Entry{}, ErrNotFound
+	}
+	value := b.Get(key)
+	if value == nil {
+		return Entry{}, ErrNotFound
+	}
+
+	return Entry{Key: key, Value: clone(value)}, nil
+}
+
+func (t *bboltTx) GetAll(bucket string) (entries []Entry, err error) {
+	b, err := t.bucket(bboltKVName(bucket), false)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	err = b.ForEach(func(key, value []byte) error {
+		entries = append(entries, Entry{Key: clone(key), Value: clone(value)})
+		return nil
+	})
+
+	return entries, err
+}
+
+func (t *bboltTx) Put(bucket string, key, value []byte) error {
+	b, err := t.bucket(bboltKVName(bucket), true)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(key, value)
+}
+
+func (t *bboltTx) Delete(bucket string, key []byte) error {
+	b, err := t.bucket(bboltKVName(bucket), false)
+	if err != nil || b == nil {
+		return err
+	}
+
+	return b.Delete(key)
+}
+
+func listKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func (t *bboltTx) push(bucket string, key, value []byte, toHead bool) error {
+	b, err := t.bucket(bboltListName(bucket, key), true)
+	if err != nil {
+		return err
+	}
+
+	seq := bboltListMiddle
+	cursor := b.Cursor()
+	if toHead {
+		if first, _ := cursor.First(); first != nil {
+			seq = binary.BigEndian.Uint64(first) - 1
+		}
+	} else {
+		if last, _ := cursor.Last(); last != nil {
+			seq = binary.BigEndian.Uint64(last) + 1
+		}
+	}
+
+	return b.Put(listKey(seq), value)
+}
+
+func (t *bboltTx) RPush(bucket string, key, value []byte) error {
+	return t.push(bucket, key, value, false)
+}
+
+func (t *bboltTx) LPush(bucket string, key, value []byte) error {
+	return t.push(bucket, key, value, true)
+}
+
+func (t *bboltTx) LPop(bucket string, key []byte) ([]byte, error) {
+	b, err := t.bucket(bboltListName(bucket, key), false)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	first, value := b.Cursor().First()
+	if first == nil {
+		return nil, nil
+	}
+	value = clone(value)
+	if err := b.Delete(first); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (t *bboltTx) LSize(bucket string, key []byte) (int, error) {
+	b, err := t.bucket(bboltListName(bucket, key), false)
+	if err != nil || b == nil {
+		return 0, err
+	}
+
+	// b.Stats() would be faster, but it does not see the changes made by the
+	// current transaction
+	size := 0
+	cursor := b.Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		size++
+	}
+
+	return size, nil
+}
+
+func (t *bboltTx) LRange(bucket string, key []byte) (values [][]byte, err error) {
+	b, err := t.bucket(bboltListName(bucket, key), false)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	err = b.ForEach(func(_, value []byte) error {
+		values = append(values, clone(value))
+		return nil
+	})
+
+	return values, err
+}
+
+func (t *bboltTx) SAdd(bucket string, key, member []byte) error {
+	b, err := t.bucket(bboltSetName(bucket, key), true)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(member, []byte{})
+}
+
+func (t *bboltTx) SRem(bucket string, key, member []byte) error {
+	b, err := t.bucket(bboltSetName(bucket, key), false)
+	if err != nil || b == nil {
+		return err
+	}
+
+	return b.Delete(member)
+}
+
+func (t *bboltTx) SIsMember(bucket string, key, member []byte) (bool, error) {
+	b, err := t.bucket(bboltSetName(bucket, key), false)
+	if err != nil || b == nil {
+		return false, err
+	}
+
+	return b.Get(member) != nil, nil
+}
+
+func (t *bboltTx) SMembers(bucket string, key []byte) (members [][]byte, err error) {
+	b, err := t.bucket(bboltSetName(bucket, key), false)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	err = b.ForEach(func(member, _ []byte) error {
+		members = append(members, clone(member))
+		return nil
+	})
+
+	return members, err
+}
@@ -0,0 +1,263 @@
+package queue
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// the memory backend keeps everything in maps, and forgets it all on exit.
+// it is good for tests and for short crawls, which are not going to be
+// resumed anyway. transactions are serialized by a lock, and every change
+// leaves an undo record, so a failed transaction can be rolled back.
+
+const BackendMemory = "memory"
+
+func init() {
+	RegisterBackend(BackendMemory, Backend{Open: openMemory, Persistent: false})
+}
+
+type memoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+	lists   map[string][][]byte
+	sets    map[string]map[string]struct{}
+}
+
+type memoryTx struct {
+	s        *memoryStore
+	writable bool
+	undo     []func()
+}
+
+func openMemory(string) (Store, error) {
+	return &memoryStore{
+		buckets: map[string]map[string][]byte{},
+		lists:   map[string][][]byte{},
+		sets:    map[string]map[string]struct{}{},
+	}, nil
+}
+
+func (s *memoryStore) View(fn func(tx Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&memoryTx{s: s})
+}
+
+func (s *memoryStore) Update(fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{s: s, writable: true}
+	err := fn(tx)
+	if err != nil {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+	}
+
+	return err
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// lists and sets are keyed by bucket and key together
+func memoryKey(bucket string, key []byte) string {
+	return bucket + "\x00" + string(key)
+}
+
+func (t *memoryTx) checkWritable() error {
+	if !t.writable {
+		return errReadOnlyTx
+	}
+	return nil
+}
+
+func (t *memoryTx) Get(bucket string, key []byte) (Entry, error) {
+	value, ok := t.s.buckets[bucket][string(key)]
+	if !ok {
+		return Entry{}, ErrNotFound
+	}
+
+	return Entry{Key: key, Value: value}, nil
+}
+
+func (t *memoryTx) GetAll(bucket string) ([]Entry, error) {
+	entries := make([]Entry, 0, len(t.s.buckets[bucket]))
+	for key, value := range t.s.buckets[bucket] {
+		entries = append(entries, Entry{Key: []byte(key), Value: value})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+
+	return entries, nil
+}
+
+func (t *memoryTx) Put(bucket string, key, value []byte) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	b, ok := t.s.buckets[bucket]
+	if !ok {
+		b = map[string][]byte{}
+		t.s.buckets[bucket] = b
+	}
+	k := string(key)
+	previous, existed := b[k]
+	t.undo = append(t.undo, func() {
+		if existed {
+			b[k] = previous
+		} else {
+			delete(b, k)
+		}
+	})
+	// the caller can reuse its slice
+	b[k] = bytes.Clone(value)
+
+	return nil
+}
+
+func (t *memoryTx) Delete(bucket string, key []byte) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	b := t.s.buckets[bucket]
+	k := string(key)
+	previous, existed := b[k]
+	if !existed {
+		return nil
+	}
+	t.undo = append(t.undo, func() { b[k] = previous })
+	delete(b, k)
+
+	return nil
+}
+
+func (t *memoryTx) setList(k string, list [][]byte) {
+	previous, existed := t.s.lists[k]
+	t.undo = append(t.undo, func() {
+		if existed {
+			t.s.lists[k] = previous
+		} else {
+			delete(t.s.lists, k)
+		}
+	})
+	t.s.lists[k] = list
+}
+
+func (t *memoryTx) RPush(bucket string, key, value []byte) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	k := memoryKey(bucket, key)
+	list, existed := t.s.lists[k]
+	// pushes are what seeding and migration are made of, so the list is not
+	// copied; the undo record just cuts it back. the changes are undone in
+	// reverse order, so by then the list is the same as right after the push
+	length := len(list)
+	t.undo = append(t.undo, func() {
+		if existed {
+			t.s.lists[k] = t.s.lists[k][:length]
+		} else {
+			delete(t.s.lists, k)
+		}
+	})
+	t.s.lists[k] = append(list, bytes.Clone(value))
+
+	return nil
+}
+
+func (t *memoryTx) LPush(bucket string, key, value []byte) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	k := memoryKey(bucket, key)
+	// a new slice, so the undo record keeps the old one intact; LPush is only
+	// used to requeue the leases, so that is fine
+	list := make([][]byte, 0, len(t.s.lists[k])+1)
+	list = append(append(list, bytes.Clone(value)), t.s.lists[k]...)
+	t.setList(k, list)
+
+	return nil
+}
+
+func (t *memoryTx) LPop(bucket string, key []byte) ([]byte, error) {
+	if err := t.checkWritable(); err != nil {
+		return nil, err
+	}
+	k := memoryKey(bucket, key)
+	list := t.s.lists[k]
+	if len(list) == 0 {
+		return nil, nil
+	}
+	// reslicing keeps the old slice intact for the undo record
+	t.setList(k, list[1:])
+
+	return list[0], nil
+}
+
+func (t *memoryTx) LSize(bucket string, key []byte) (int, error) {
+	return len(t.s.lists[memoryKey(bucket, key)]), nil
+}
+
+func (t *memoryTx) LRange(bucket string, key []byte) ([][]byte, error) {
+	list := t.s.lists[memoryKey(bucket, key)]
+	values := make([][]byte, len(list))
+	copy(values, list)
+
+	return values, nil
+}
+
+func (t *memoryTx) SAdd(bucket string, key, member []byte) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	k := memoryKey(bucket, key)
+	set, ok := t.s.sets[k]
+	if !ok {
+		set = map[string]struct{}{}
+		t.s.sets[k] = set
+	}
+	m := string(member)
+	if _, existed := set[m]; existed {
+		return nil
+	}
+	t.undo = append(t.undo, func() { delete(set, m) })
+	set[m] = struct{}{}
+
+	return nil
+}
+
+func (t *memoryTx) SRem(bucket string, key, member []byte) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	set := t.s.sets[memoryKey(bucket, key)]
+	m := string(member)
+	if _, existed := set[m]; !existed {
+		return nil
+	}
+	t.undo = append(t.undo, func() { set[m] = struct{}{} })
+	delete(set, m)
+
+	return nil
+}
+
+func (t *memoryTx) SIsMember(bucket string, key, member []byte) (bool, error) {
+	_, ok := t.s.sets[memoryKey(bucket, key)][string(member)]
+	return ok, nil
+}
+
+func (t *memoryTx) SMembers(bucket string, key []byte) ([][]byte, error) {
+	set := t.s.sets[memoryKey(bucket, key)]
+	members := make([][]byte, 0, len(set))
+	for member := range set {
+		members = append(members, []byte(member))
+	}
+
+	return members, nil
+}
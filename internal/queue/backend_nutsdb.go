@@ -0,0 +1,287 @@
+package queue
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/nutsdb/nutsdb"
+)
+
+// NutsDB is the original backend (see MADR 002). It has lists and sets of its
+// own, so this is just a thin layer over it, mostly to tame its errors.
+
+const BackendNutsDB = "nutsdb"
+
+func init() {
+	RegisterBackend(BackendNutsDB, Backend{Open: openNutsDB, Persistent: true})
+}
+
+type nutsStore struct {
+	db *nutsdb.DB
+}
+
+// NutsDB checks deletes against the committed data only, so deleting a key
+// (or a set member) written earlier in the same transaction is silently lost.
+// to keep the Tx contract, key-value and set writes are staged in nutsTx, and
+// only the last write to every key (or member) is passed to NutsDB, when the
+// transaction is done
+type nutsTx struct {
+	tx       *nutsdb.Tx
+	writable bool
+	// nil value means a delete
+	values  map[nutsKey][]byte
+	members map[nutsMember]bool
+}
+
+type nutsKey struct {
+	bucket, key string
+}
+
+type nutsMember struct {
+	bucket, key, member string
+}
+
+func openNutsDB(dir string) (Store, error) {
+	db, err := nutsdb.Open(
+		nutsdb.DefaultOptions,
+		nutsdb.WithDir(dir),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nutsStore{db: db}, nil
+}
+
+// NutsDB flattens the error of a transaction into a string, so the one we
+// return is kept aside, for the callers to be able to check it with errors.Is
+
+func (s *nutsStore) View(fn func(tx Tx) error) error {
+	var fnErr error
+	err := s.db.View(func(tx *nutsdb.Tx) error {
+		fnErr = fn(&nutsTx{tx: tx})
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+
+	return err
+}
+
+func (s *nutsStore) Update(fn func(tx Tx) error) error {
+	var fnErr error
+	err := s.db.Update(func(tx *nutsdb.Tx) error {
+		t := &nutsTx{
+			tx:       tx,
+			writable: true,
+			values:   map[nutsKey][]byte{},
+			members:  map[nutsMember]bool{},
+		}
+		fnErr = fn(t)
+		if fnErr == nil {
+			fnErr = t.flush()
+		}
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+
+	return err
+}
+
+func (s *nutsStore) Close() error {
+	return s.db.Close()
+}
+
+// isNutsNotFound tells if the error means that there is no such key or bucket
+// yet. nutsdb has a few flavours of those, and not all of them are exported
+// (nutsdb.ErrRecordIsNil should be, but it is not...), so we check the error
+// text as well
+func isNutsNotFound(err error) bool {
+	return errors.Is(err, nutsdb.ErrKeyNotFound) ||
+		errors.Is(err, nutsdb.ErrBucketNotFound) ||
+		errors.Is(err, nutsdb.ErrBucketEmpty) ||
+		errors.Is(err, nutsdb.ErrListNotFound) ||
+		errors.Is(err, nutsdb.ErrSetMemberNotExist) ||
+		strings.Contains(err.Error(), "not found") ||
+		err.Error() == "the record is nil"
+}
+
+// flush passes the staged writes to NutsDB
+func (t *nutsTx) flush() error {
+	for k, value := range t.values {
+		var err error
+		if value == nil {
+			err = t.tx.Delete(k.bucket, []byte(k.key))
+		} else {
+			err = t.tx.Put(k.bucket, []byte(k.key), value, nutsdb.Persistent)
+		}
+		if err != nil && !isNutsNotFound(err) {
+			return err
+		}
+	}
+	for m, added := range t.members {
+		var err error
+		if added {
+			err = t.tx.SAdd(m.bucket, []byte(m.key), []byte(m.member))
+		} else {
+			err = t.tx.SRem(m.bucket, []byte(m.key), []byte(m.member))
+		}
+		if err != nil && !isNutsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *nutsTx) checkWritable() error {
+	if !t.writable {
+		return errReadOnlyTx
+	}
+	return nil
+}
+
+func (t *nutsTx) Get(bucket string, key []byte) (Entry, error) {
+	entry, err := t.tx.Get(bucket, key)
+	if err != nil {
+		if isNutsNotFound(err) {
+			return Entry{}, ErrNotFound
+		}
+		return Entry{}, err
+	}
+
+	return Entry{Key: entry.Key, Value: entry.Value}, nil
+}
+
+func (t *nutsTx) GetAll(bucket string) ([]Entry, error) {
+	entries, err := t.tx.GetAll(bucket)
+	if err != nil {
+		if isNutsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	result := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, Entry{Key: entry.Key, Value: entry.Value})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(result[i].Key, result[j].Key) < 0
+	})
+
+	return result, nil
+}
+
+func (t *nutsTx) Put(bucket string, key, value []byte) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	if value == nil {
+		// a nil value would be taken for a delete
+		value = []byte{}
+	}
+	t.values[nutsKey{bucket: bucket, key: string(key)}] = value
+
+	return nil
+}
+
+func (t *nutsTx) Delete(bucket string, key []byte) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	t.values[nutsKey{bucket: bucket, key: string(key)}] = nil
+
+	return nil
+}
+
+func (t *nutsTx) RPush(bucket string, key, value []byte) error {
+	return t.tx.RPush(bucket, key, value)
+}
+
+func (t *nutsTx) LPush(bucket string, key, value []byte) error {
+	return t.tx.LPush(bucket, key, value)
+}
+
+func (t *nutsTx) LPop(bucket string, key []byte) ([]byte, error) {
+	value, err := t.tx.LPop(bucket, key)
+	if err != nil {
+		if isNutsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func (t *nutsTx) LSize(bucket string, key []byte) (int, error) {
+	size, err := t.tx.LSize(bucket, key)
+	if err != nil {
+		if isNutsNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func (t *nutsTx) LRange(bucket string, key []byte) ([][]byte, error) {
+	values, err := t.tx.LRange(bucket, key, 0, -1)
+	if err != nil {
+		if isNutsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func (t *nutsTx) SAdd(bucket string, key, member []byte) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	t.members[nutsMember{bucket: bucket, key: string(key), member: string(member)}] = true
+
+	return nil
+}
+
+func (t *nutsTx) SRem(bucket string, key, member []byte) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	t.members[nutsMember{bucket: bucket, key: string(key), member: string(member)}] = false
+
+	return nil
+}
+
+func (t *nutsTx) SIsMember(bucket string, key, member []byte) (bool, error) {
+	isMember, err := t.tx.SIsMember(bucket, key, member)
+	if err != nil {
+		if isNutsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return isMember, nil
+}
+
+func (t *nutsTx) SMembers(bucket string, key []byte) ([][]byte, error) {
+	members, err := t.tx.SMembers(bucket, key)
+	if err != nil {
+		if isNutsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return members, nil
+}
@@ -0,0 +1,304 @@
+package queue
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+func TestMain(m *testing.M) {
+	// the queue logs through the settings
+	logger := zerolog.Nop()
+	startUrlObject, _ := url.Parse("https://example.com/")
+	settings.Save(settings.Params{URL: startUrlObject, Logger: &logger})
+
+	os.Exit(m.Run())
+}
+
+// forEachBackend runs a test against a fresh store of every registered backend
+func forEachBackend(t *testing.T, test func(t *testing.T, store Store)) {
+	for _, name := range Backends() {
+		t.Run(name, func(t *testing.T) {
+			store, err := OpenStore(name, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := store.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+			test(t, store)
+		})
+	}
+}
+
+func update(t *testing.T, store Store, fn func(tx Tx) error) {
+	t.Helper()
+	if err := store.Update(fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func view(t *testing.T, store Store, fn func(tx Tx) error) {
+	t.Helper()
+	if err := store.View(fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func strs(values [][]byte) []string {
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		result = append(result, string(value))
+	}
+	return result
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBackendKV(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		view(t, store, func(tx Tx) error {
+			if _, err := tx.Get("b", []byte("missing")); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of a missing key: got %v, expected ErrNotFound", err)
+			}
+			if entries, err := tx.GetAll("b"); err != nil || len(entries) > 0 {
+				t.Errorf("GetAll of a missing bucket: got %v, %v", entries, err)
+			}
+			return nil
+		})
+
+		update(t, store, func(tx Tx) error {
+			for _, key := range []string{"c", "a", "b"} {
+				if err := tx.Put("b", []byte(key), []byte(key+"1")); err != nil {
+					return err
+				}
+			}
+			if err := tx.Delete("b", []byte("missing")); err != nil {
+				t.Errorf("Delete of a missing key: %v", err)
+			}
+			return tx.Delete("b", []byte("b"))
+		})
+
+		view(t, store, func(tx Tx) error {
+			entry, err := tx.Get("b", []byte("a"))
+			if err != nil || string(entry.Value) != "a1" {
+				t.Errorf("Get: got %q, %v", entry.Value, err)
+			}
+			entries, err := tx.GetAll("b")
+			if err != nil {
+				return err
+			}
+			var keys []string
+			for _, entry := range entries {
+				keys = append(keys, string(entry.Key))
+			}
+			if !equal(keys, []string{"a", "c"}) {
+				t.Errorf("GetAll: got %v, expected sorted [a c]", keys)
+			}
+			return nil
+		})
+	})
+}
+
+func TestBackendList(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		key := []byte("list")
+
+		update(t, store, func(tx Tx) error {
+			value, err := tx.LPop("l", key)
+			if err != nil || value != nil {
+				t.Errorf("LPop of a missing list: got %q, %v", value, err)
+			}
+			return nil
+		})
+
+		update(t, store, func(tx Tx) error {
+			for _, value := range []string{"a", "b", "c"} {
+				if err := tx.RPush("l", key, []byte(value)); err != nil {
+					return err
+				}
+			}
+			return tx.LPush("l", key, []byte("z"))
+		})
+
+		update(t, store, func(tx Tx) error {
+			values, err := tx.LRange("l", key)
+			if err != nil {
+				return err
+			}
+			if !equal(strs(values), []string{"z", "a", "b", "c"}) {
+				t.Errorf("LRange: got %q", values)
+			}
+			size, err := tx.LSize("l", key)
+			if err != nil || size != 4 {
+				t.Errorf("LSize: got %d, %v", size, err)
+			}
+			value, err := tx.LPop("l", key)
+			if err != nil || string(value) != "z" {
+				t.Errorf("LPop: got %q, %v", value, err)
+			}
+			return nil
+		})
+
+		view(t, store, func(tx Tx) error {
+			values, err := tx.LRange("l", key)
+			if err != nil {
+				return err
+			}
+			if !equal(strs(values), []string{"a", "b", "c"}) {
+				t.Errorf("LRange after LPop: got %q", values)
+			}
+			return nil
+		})
+
+		// popping everything leaves an empty list, not a broken one
+		update(t, store, func(tx Tx) error {
+			for i := 0; i < 4; i++ {
+				if _, err := tx.LPop("l", key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		view(t, store, func(tx Tx) error {
+			size, err := tx.LSize("l", key)
+			if err != nil || size != 0 {
+				t.Errorf("LSize of an emptied list: got %d, %v", size, err)
+			}
+			return nil
+		})
+	})
+}
+
+func TestBackendSet(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		key := []byte("set")
+
+		view(t, store, func(tx Tx) error {
+			isMember, err := tx.SIsMember("s", key, []byte("a"))
+			if err != nil || isMember {
+				t.Errorf("SIsMember of a missing set: got %v, %v", isMember, err)
+			}
+			return nil
+		})
+
+		update(t, store, func(tx Tx) error {
+			for _, member := range []string{"a", "b", "a", "c"} {
+				if err := tx.SAdd("s", key, []byte(member)); err != nil {
+					return err
+				}
+			}
+			if err := tx.SRem("s", key, []byte("missing")); err != nil {
+				t.Errorf("SRem of a missing member: %v", err)
+			}
+			return tx.SRem("s", key, []byte("b"))
+		})
+
+		view(t, store, func(tx Tx) error {
+			for member, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+				isMember, err := tx.SIsMember("s", key, []byte(member))
+				if err != nil || isMember != expected {
+					t.Errorf("SIsMember(%s): got %v, %v", member, isMember, err)
+				}
+			}
+			members, err := tx.SMembers("s", key)
+			if err != nil {
+				return err
+			}
+			sorted := strs(members)
+			sort.Strings(sorted)
+			if !equal(sorted, []string{"a", "c"}) {
+				t.Errorf("SMembers: got %q", sorted)
+			}
+			return nil
+		})
+	})
+}
+
+// the writes are visible once the transaction is committed, and not at all if
+// it fails. whether they are visible inside the transaction itself is up to
+// the backend (see Tx), so that is not checked
+func TestBackendTransactions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		key := []byte("k")
+
+		update(t, store, func(tx Tx) error {
+			if err := tx.Put("b", key, []byte("committed")); err != nil {
+				return err
+			}
+			if err := tx.RPush("l", key, []byte("committed")); err != nil {
+				return err
+			}
+			return tx.SAdd("s", key, []byte("committed"))
+		})
+
+		failure := errors.New("failure")
+		err := store.Update(func(tx Tx) error {
+			if err := tx.Put("b", key, []byte("rolled back")); err != nil {
+				return err
+			}
+			if err := tx.Put("b", []byte("new"), []byte("rolled back")); err != nil {
+				return err
+			}
+			if err := tx.RPush("l", key, []byte("rolled back")); err != nil {
+				return err
+			}
+			if _, err := tx.LPop("l", key); err != nil {
+				return err
+			}
+			if err := tx.SAdd("s", key, []byte("rolled back")); err != nil {
+				return err
+			}
+			if err := tx.SRem("s", key, []byte("committed")); err != nil {
+				return err
+			}
+			return failure
+		})
+		if !errors.Is(err, failure) {
+			t.Fatalf("Update: got %v, expected the error of the transaction", err)
+		}
+
+		view(t, store, func(tx Tx) error {
+			entry, err := tx.Get("b", key)
+			if err != nil || string(entry.Value) != "committed" {
+				t.Errorf("Get after rollback: got %q, %v", entry.Value, err)
+			}
+			if _, err := tx.Get("b", []byte("new")); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of a key added by a rolled back transaction: got %v", err)
+			}
+			values, err := tx.LRange("l", key)
+			if err != nil {
+				return err
+			}
+			if !equal(strs(values), []string{"committed"}) {
+				t.Errorf("LRange after rollback: got %q", values)
+			}
+			members, err := tx.SMembers("s", key)
+			if err != nil {
+				return err
+			}
+			if !equal(strs(members), []string{"committed"}) {
+				t.Errorf("SMembers after rollback: got %q", members)
+			}
+			return nil
+		})
+	})
+}
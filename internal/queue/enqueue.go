@@ -0,0 +1,110 @@
+package queue
+
+// found links are checked against everything we know (processed, queued, in
+// progress) and queued in the same transaction. with separate transactions for
+// the checks and the adding, two workers finding the same link would race,
+// and a page with hundreds of links would cost hundreds of transactions.
+
+// EnqueueOutcome tells what EnqueueUnseen did with a task
+type EnqueueOutcome int
+
+const (
+	// the task was not looked at (e.g., the transaction failed)
+	OutcomeSkipped EnqueueOutcome = iota
+	// the task is added to the queue
+	OutcomeQueued
+	// the task is too deep to follow, it is recorded as discovered instead
+	OutcomeDiscovered
+	// the task is waiting in the queue already (or for a retry)
+	OutcomeAlreadyQueued
+	// the task is being worked on right now
+	OutcomeInProgress
+	// we are done with the task already (or gave up on it)
+	OutcomeProcessed
+)
+
+func (o EnqueueOutcome) String() string {
+	switch o {
+	case OutcomeQueued:
+		return "queued"
+	case OutcomeDiscovered:
+		return "discovered"
+	case OutcomeAlreadyQueued:
+		return "already queued"
+	case OutcomeInProgress:
+		return "in progress"
+	case OutcomeProcessed:
+		return "processed"
+	default:
+		return "skipped"
+	}
+}
+
+// EnqueueUnseen adds the tasks we have not seen yet to the queue, all in one
+// transaction; the tasks deeper than maxDepth (if it is not zero) are recorded
+// as discovered instead. Returns an outcome for every task, in the same order.
+// If the same URL is given twice, the first one wins, and the others get its
+// outcome (OutcomeAlreadyQueued if it was queued).
+func (q *queue) EnqueueUnseen(tasks []Task, maxDepth int) (outcomes []EnqueueOutcome, err error) {
+	outcomes = make([]EnqueueOutcome, len(tasks))
+	if len(tasks) == 0 {
+		return outcomes, nil
+	}
+
+	err = q.db.Update(
+		func(tx Tx) error {
+			// the checks can't see what this very transaction has queued (see
+			// Tx), and pages repeat their links all the time
+			seen := make(map[string]EnqueueOutcome, len(tasks))
+			for i, task := range tasks {
+				if outcome, ok := seen[task.URL]; ok {
+					if outcome == OutcomeQueued {
+						outcome = OutcomeAlreadyQueued
+					}
+					outcomes[i] = outcome
+					continue
+				}
+
+				outcome, err := enqueueUnseen(tx, task, maxDepth)
+				if err != nil {
+					return err
+				}
+				outcomes[i] = outcome
+				seen[task.URL] = outcome
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		// nothing is done, the transaction is rolled back
+		return make([]EnqueueOutcome, len(tasks)), err
+	}
+
+	return outcomes, nil
+}
+
+func enqueueUnseen(tx Tx, task Task, maxDepth int) (EnqueueOutcome, error) {
+	val := []byte(task.URL)
+
+	processed, err := isProcessed(tx, val)
+	if err != nil || processed {
+		return OutcomeProcessed, err
+	}
+	queued, err := isInQueue(tx, val)
+	if err != nil || queued {
+		return OutcomeAlreadyQueued, err
+	}
+	inProgress, err := isInProgress(tx, val)
+	if err != nil || inProgress {
+		return OutcomeInProgress, err
+	}
+
+	// the queue is FIFO, so the first time we find a link is (almost always)
+	// the shortest way to it
+	if maxDepth > 0 && task.Depth > maxDepth {
+		return OutcomeDiscovered, addDiscovered(tx, task)
+	}
+
+	return OutcomeQueued, addTaskWithInfo(tx, task)
+}
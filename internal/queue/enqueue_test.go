@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestEnqueueUnseen(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		q := &queue{db: store}
+		update(t, store, func(tx Tx) error {
+			if err := addTask(tx, []byte("https://example.com/queued")); err != nil {
+				return err
+			}
+			if err := tx.Put(leaseBucket, []byte("https://example.com/leased"), []byte("2023-01-01T00:00:00Z")); err != nil {
+				return err
+			}
+			return tx.SAdd(setBucket, processedSetKey, []byte("https://example.com/processed"))
+		})
+
+		outcomes, err := q.EnqueueUnseen([]Task{
+			{URL: "https://example.com/new", Depth: 1},
+			// the same link twice on a page is the usual thing
+			{URL: "https://example.com/new", Depth: 1},
+			{URL: "https://example.com/queued", Depth: 1},
+			{URL: "https://example.com/leased", Depth: 1},
+			{URL: "https://example.com/processed", Depth: 1},
+			{URL: "https://example.com/deep", Depth: 3},
+			{URL: "https://example.com/deep", Depth: 3},
+		}, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []EnqueueOutcome{
+			OutcomeQueued,
+			OutcomeAlreadyQueued,
+			OutcomeAlreadyQueued,
+			OutcomeInProgress,
+			OutcomeProcessed,
+			OutcomeDiscovered,
+			OutcomeDiscovered,
+		}
+		for i := range expected {
+			if outcomes[i] != expected[i] {
+				t.Errorf("outcomes: got %v, expected %v", outcomes, expected)
+				break
+			}
+		}
+
+		view(t, store, func(tx Tx) error {
+			values, err := tx.LRange(listBucket, mainListKey)
+			if err != nil {
+				return err
+			}
+			if !equal(strs(values), []string{"https://example.com/queued", "https://example.com/new"}) {
+				t.Errorf("queue: got %q", values)
+			}
+			return nil
+		})
+		discovered, err := q.Discovered()
+		if err != nil || len(discovered) != 1 || discovered[0].URL != "https://example.com/deep" {
+			t.Errorf("discovered: got %v, %v", discovered, err)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+package queue
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	// url -> Metadata
+	metadataBucket string = "crawlerMetadata"
+)
+
+// Metadata tells how the document of a given URL was fetched, and where it is
+// stored. It is saved for every response we got, including the ones we did
+// not store (bad status, non-text content-type) — Path is empty for those.
+type Metadata struct {
+	// relative to the crawling dir, with forward slashes
+	Path string `json:"path"`
+	// media type only, without parameters, lowercased
+	ContentType string `json:"contentType"`
+
+	StatusCode int `json:"statusCode,omitempty"`
+	// the URL we ended up at, after redirects
+	FinalURL string `json:"finalUrl,omitempty"`
+	// the redirects we went through to get there, in order. if the last one
+	// was not followed, FinalURL is the URL that responded with it
+	RedirectChain []Redirect  `json:"redirectChain,omitempty"`
+	ETag          string      `json:"etag,omitempty"`
+	LastModified  string      `json:"lastModified,omitempty"`
+	Header        http.Header `json:"header,omitempty"`
+	Size          int64       `json:"size,omitempty"`
+	// the document was bigger than the limit, and we have cut it (Truncated),
+	// or did not download it at all (Oversized)
+	Truncated bool `json:"truncated,omitempty"`
+	Oversized bool `json:"oversized,omitempty"`
+	// the encoding of HTML and CSS documents, like "windows-1251"; Transcoded
+	// means the stored file is converted to UTF-8 (size and digest are still
+	// of the original)
+	Charset    string `json:"charset,omitempty"`
+	Transcoded bool   `json:"transcoded,omitempty"`
+	// the canonical URL the document declared, if it is not the same as its own
+	Canonical string `json:"canonical,omitempty"`
+	// sha256 of the body, to tell if the document has changed on recrawl
+	Digest    string        `json:"digest,omitempty"`
+	FetchedAt time.Time     `json:"fetchedAt"`
+	FetchTook time.Duration `json:"fetchTook,omitempty"`
+}
+
+// Redirect is a hop in a redirect chain: the URL that responded with a
+// redirect, and the status it used
+type Redirect struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"statusCode"`
+}
+
+// SetMetadata saves the metadata of a given URL, replacing the previous one
+func (q *queue) SetMetadata(value string, metadata Metadata) error {
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	return q.db.Update(
+		func(tx Tx) error {
+			return tx.Put(metadataBucket, []byte(value), encoded)
+		},
+	)
+}
+
+// Metadata returns the metadata of a given URL; found is false if we never
+// fetched it
+func (q *queue) Metadata(value string) (metadata Metadata, found bool, err error) {
+	err = q.db.View(
+		func(tx Tx) error {
+			entry, err := tx.Get(metadataBucket, []byte(value))
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(entry.Value, &metadata)
+		},
+	)
+	if err != nil {
+		if isNotFound(err) {
+			return Metadata{}, false, nil
+		}
+		return Metadata{}, false, err
+	}
+
+	return metadata, true, nil
+}
+
+// AllMetadata returns all the known URL -> Metadata pairs
+func (q *queue) AllMetadata() (all map[string]Metadata, err error) {
+	all = make(map[string]Metadata)
+	err = q.db.View(
+		func(tx Tx) error {
+			entries, err := tx.GetAll(metadataBucket)
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				var metadata Metadata
+				if err := json.Unmarshal(entry.Value, &metadata); err != nil {
+					continue
+				}
+				all[string(entry.Key)] = metadata
+			}
+
+			return nil
+		},
+	)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+
+	return all, nil
+}
@@ -0,0 +1,161 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+)
+
+// all the key-value buckets the queue keeps its data in; a new bucket must be
+// added here too, or it will be lost in the migration
+var migratedBuckets = []string{
+	taskBucket,
+	discoveredBucket,
+	lastmodBucket,
+	leaseBucket,
+	attemptsBucket,
+	retryBucket,
+	deadLetterBucket,
+	metadataBucket,
+	pathsBucket,
+	usageBucket,
+}
+
+// MigrationReport tells how much of the crawl state was copied
+type MigrationReport struct {
+	Pending    int
+	InProgress int
+	Processed  int
+	// key-value pairs of all kinds: tasks, metadata, leases, etc
+	Entries int
+}
+
+// Migrate copies the queue data from one backend to another, in a given
+// folder. The target store must be empty. The source store is left as it is,
+// so if anything goes wrong, the crawl can be continued with the old backend.
+func Migrate(fromBackend, toBackend, dir string) (report MigrationReport, err error) {
+	if fromBackend == toBackend {
+		return report, fmt.Errorf("can't migrate queue from %s to itself", fromBackend)
+	}
+	for _, name := range []string{fromBackend, toBackend} {
+		if _, ok := backends[name]; !ok {
+			return report, fmt.Errorf("unknown queue backend %q", name)
+		}
+		// there would be nothing to migrate from, or it would be lost on exit
+		if !IsPersistent(name) {
+			return report, fmt.Errorf("queue backend %s does not keep its data, there is nothing to migrate", name)
+		}
+	}
+
+	from, err := OpenStore(fromBackend, dir)
+	if err != nil {
+		return report, err
+	}
+	defer func() {
+		err = errors.Join(err, from.Close())
+	}()
+	to, err := OpenStore(toBackend, dir)
+	if err != nil {
+		return report, err
+	}
+	defer func() {
+		err = errors.Join(err, to.Close())
+	}()
+
+	// one transaction on each side, so we get a consistent snapshot, and the
+	// target either gets all of it or nothing
+	err = from.View(
+		func(src Tx) error {
+			return to.Update(
+				func(dst Tx) error {
+					empty, err := isEmpty(dst)
+					if err != nil {
+						return err
+					}
+					if !empty {
+						return fmt.Errorf("queue backend %s already has data in %s", toBackend, dir)
+					}
+
+					report, err = migrate(src, dst)
+					return err
+				},
+			)
+		},
+	)
+	if err != nil {
+		return MigrationReport{}, err
+	}
+
+	return report, nil
+}
+
+func isEmpty(tx Tx) (bool, error) {
+	size, err := tx.LSize(listBucket, mainListKey)
+	if err != nil || size > 0 {
+		return false, err
+	}
+	for _, key := range [][]byte{mainSetKey, processedSetKey} {
+		members, err := tx.SMembers(setBucket, key)
+		if err != nil || len(members) > 0 {
+			return false, err
+		}
+	}
+	for _, bucket := range migratedBuckets {
+		entries, err := tx.GetAll(bucket)
+		if err != nil || len(entries) > 0 {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func migrate(src, dst Tx) (report MigrationReport, err error) {
+	for _, bucket := range migratedBuckets {
+		entries, err := src.GetAll(bucket)
+		if err != nil {
+			return report, err
+		}
+		for _, entry := range entries {
+			if err := dst.Put(bucket, entry.Key, entry.Value); err != nil {
+				return report, err
+			}
+		}
+		report.Entries += len(entries)
+		switch bucket {
+		case leaseBucket:
+			report.InProgress = len(entries)
+		case retryBucket:
+			// waiting for a retry is still being in the queue
+			report.Pending += len(entries)
+		}
+	}
+
+	// the order of the queue is kept
+	values, err := src.LRange(listBucket, mainListKey)
+	if err != nil {
+		return report, err
+	}
+	for _, val := range values {
+		if err := dst.RPush(listBucket, mainListKey, val); err != nil {
+			return report, err
+		}
+	}
+	report.Pending += len(values)
+
+	for _, key := range [][]byte{mainSetKey, processedSetKey} {
+		members, err := src.SMembers(setBucket, key)
+		if err != nil {
+			return report, err
+		}
+		for _, member := range members {
+			if err := dst.SAdd(setBucket, key, member); err != nil {
+				return report, err
+			}
+		}
+		if string(key) == string(processedSetKey) {
+			report.Processed = len(members)
+		}
+	}
+
+	return report, nil
+}
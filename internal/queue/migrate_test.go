@@ -0,0 +1,74 @@
+package queue
+
+import (
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	// Migrate itself wants persistent backends on both sides, but the copying
+	// works the same with any of them
+	from, err := OpenStore(BackendMemory, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := OpenStore(BackendBbolt, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = to.Close()
+	}()
+
+	update(t, from, func(tx Tx) error {
+		for _, value := range []string{"https://example.com/a", "https://example.com/b"} {
+			if err := addTaskWithInfo(tx, Task{URL: value, Depth: 1}); err != nil {
+				return err
+			}
+		}
+		if err := tx.Put(leaseBucket, []byte("https://example.com/c"), []byte("2023-01-01T00:00:00Z")); err != nil {
+			return err
+		}
+		return tx.SAdd(setBucket, processedSetKey, []byte("https://example.com/"))
+	})
+
+	var report MigrationReport
+	update(t, to, func(dst Tx) error {
+		return from.View(func(src Tx) error {
+			empty, err := isEmpty(dst)
+			if err != nil || !empty {
+				t.Fatalf("target is not empty: %v", err)
+			}
+			report, err = migrate(src, dst)
+			return err
+		})
+	})
+	expected := MigrationReport{Pending: 2, InProgress: 1, Processed: 1, Entries: 3}
+	if report != expected {
+		t.Errorf("got %+v, expected %+v", report, expected)
+	}
+
+	view(t, to, func(tx Tx) error {
+		values, err := tx.LRange(listBucket, mainListKey)
+		if err != nil {
+			return err
+		}
+		if !equal(strs(values), []string{"https://example.com/a", "https://example.com/b"}) {
+			t.Errorf("queue order is not kept: %q", values)
+		}
+		task, err := getTaskInfo(tx, taskBucket, []byte("https://example.com/b"))
+		if err != nil || task.Depth != 1 {
+			t.Errorf("task info is not copied: %+v, %v", task, err)
+		}
+		if processed, err := isProcessed(tx, []byte("https://example.com/")); err != nil || !processed {
+			t.Errorf("processed set is not copied: %v, %v", processed, err)
+		}
+		if inProgress, err := isInProgress(tx, []byte("https://example.com/c")); err != nil || !inProgress {
+			t.Errorf("leases are not copied: %v, %v", inProgress, err)
+		}
+		empty, err := isEmpty(tx)
+		if err != nil || empty {
+			t.Errorf("migrated store is empty: %v", err)
+		}
+		return nil
+	})
+}
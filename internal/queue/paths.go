@@ -0,0 +1,53 @@
+package queue
+
+// local file path -> url. Metadata has the other direction; this one tells
+// which URL a file belongs to, and makes sure two URLs never share a file
+
+const (
+	pathsBucket string = "crawlerPaths"
+)
+
+// ClaimPath records that a file path (relative to the crawling dir) belongs to
+// a given URL, unless it already belongs to another one. Returns the owner of
+// the path, which is the given URL if the claim succeeded
+func (q *queue) ClaimPath(path, value string) (owner string, err error) {
+	err = q.db.Update(
+		func(tx Tx) error {
+			entry, err := tx.Get(pathsBucket, []byte(path))
+			if err == nil {
+				owner = string(entry.Value)
+				return nil
+			}
+			if !isNotFound(err) {
+				return err
+			}
+			owner = value
+			return tx.Put(pathsBucket, []byte(path), []byte(value))
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return owner, nil
+}
+
+// PathOwner returns the URL a file path belongs to; found is false if the path
+// is not ours
+func (q *queue) PathOwner(path string) (owner string, found bool, err error) {
+	err = q.db.View(
+		func(tx Tx) error {
+			entry, err := tx.Get(pathsBucket, []byte(path))
+			if err != nil {
+				if isNotFound(err) {
+					return nil
+				}
+				return err
+			}
+			owner, found = string(entry.Value), true
+			return nil
+		},
+	)
+
+	return owner, found, err
+}
@@ -2,32 +2,56 @@ package queue
 
 import (
 	"errors"
-
-	"github.com/nutsdb/nutsdb"
+	"time"
 
 	"github.com/skaurus/ta-site-crawler/internal/settings"
 )
 
 type queue struct {
-	nutsDB *nutsdb.DB
+	db Store
 }
 
 type Queue interface {
 	Cleanup() error
-	AddTask(string) error
-	GetTask() (string, error)
+	AddTask(Task) error
+	GetTask() (Task, error)
 	IsInQueue(string) (bool, error)
+	IsInProgress(string) (bool, error)
 	MarkAsProcessed(string) error
+	MarkAsFailed(value, reason string, retryAt time.Time) error
+	Attempts(string) (int, error)
 	IsProcessed(string) (bool, error)
+	RequeueLeases(time.Duration) (int, error)
+	DeadLetters() ([]DeadLetter, error)
+	RequeueDeadLetters(...string) (int, error)
+	SetLastmods(map[string]time.Time) error
+	Lastmod(string) (time.Time, error)
+	SetMetadata(string, Metadata) error
+	Metadata(string) (Metadata, bool, error)
+	AllMetadata() (map[string]Metadata, error)
+	AddDiscovered(Task) error
+	EnqueueUnseen(tasks []Task, maxDepth int) ([]EnqueueOutcome, error)
+	Discovered() ([]Task, error)
+	Usage() (Usage, error)
+	AddUsage(pages, bytes int64, elapsed time.Duration) (Usage, error)
+	ClaimPath(path, value string) (string, error)
+	PathOwner(path string) (string, bool, error)
 }
 
 var (
 	ErrStringAlreadyInQueue = errors.New("string already in queue")
+	// ErrOnlyScheduledTasks is returned by GetTask when the queue is empty, but
+	// there are failed tasks waiting for their retry time
+	ErrOnlyScheduledTasks = errors.New("only tasks scheduled for later are left")
 )
 
 const (
-	listBucket string = "crawlerLists"
-	setBucket  string = "crawlerSets"
+	listBucket    string = "crawlerLists"
+	setBucket     string = "crawlerSets"
+	lastmodBucket string = "crawlerLastmod"
+	// tasks given out by GetTask live here (url -> lease time) until they are
+	// marked as processed or failed
+	leaseBucket string = "crawlerLeases"
 )
 
 var (
@@ -42,18 +66,30 @@ func Init() (Queue, error) {
 	runtimeSettings := settings.Get()
 	logger := runtimeSettings.Logger()
 
-	db, err := nutsdb.Open(
-		nutsdb.DefaultOptions,
-		nutsdb.WithDir(runtimeSettings.OutputDir()),
-	)
+	db, err := OpenStore(runtimeSettings.QueueBackend(), runtimeSettings.OutputDir())
 	if err != nil {
 		return nil, err
 	}
 
+	q := &queue{
+		db: db,
+	}
+
+	// any lease we see at this point is orphaned — the process holding it has
+	// died or was killed, and only one crawler instance can work with a given
+	// folder (see MADR 003). so we do not even look at lease times here
+	requeued, err := q.RequeueLeases(0)
+	if err != nil {
+		return q, err
+	}
+	if requeued > 0 {
+		logger.Info().Int("requeued", requeued).Msg("requeued tasks left in progress by the previous run")
+	}
+
 	err = db.Update(
-		func(tx *nutsdb.Tx) error {
+		func(tx Tx) error {
 			queueSize, err := tx.LSize(listBucket, mainListKey)
-			if err != nil && !errors.Is(err, nutsdb.ErrListNotFound) {
+			if err != nil {
 				logger.Debug().Err(err).Msg("LSize failed")
 				return err
 			}
@@ -61,26 +97,42 @@ func Init() (Queue, error) {
 				return nil
 			}
 
+			if runtimeSettings.Recrawl() {
+				// if the previous pass is not complete yet (there are retries
+				// scheduled), we just resume it; otherwise, everything we have
+				// processed goes to the queue again
+				scheduled, err := hasScheduledRetries(tx)
+				if err != nil || scheduled {
+					return err
+				}
+				requeued, err := startRecrawlPass(tx)
+				if err != nil {
+					return err
+				}
+				if requeued > 0 {
+					logger.Info().Int("requeued", requeued).Msg("starting a new recrawl pass")
+					return nil
+				}
+			}
+
 			val := []byte(runtimeSettings.URL().String())
 			return addTask(tx, val)
 		},
 	)
 
-	return &queue{
-		nutsDB: db,
-	}, err
+	return q, err
 }
 
 func (q *queue) Cleanup() error {
-	return q.nutsDB.Close()
+	return q.db.Close()
 }
 
-func addTask(tx *nutsdb.Tx, val []byte) error {
+func addTask(tx Tx, val []byte) error {
 	logger := settings.Get().Logger()
 
 	logger.Trace().Msg("addTask")
 	exists, err := tx.SIsMember(setBucket, mainSetKey, val)
-	if err != nil && !errors.Is(err, nutsdb.ErrBucketNotFound) {
+	if err != nil {
 		logger.Debug().Err(err).Msg("SIsMember failed")
 		return err
 	}
@@ -101,12 +153,24 @@ func addTask(tx *nutsdb.Tx, val []byte) error {
 	return nil
 }
 
-func (q *queue) AddTask(value string) (err error) {
-	err = q.nutsDB.Update(
-		func(tx *nutsdb.Tx) error {
-			val := []byte(value)
+// addTaskWithInfo queues a task, and keeps what we know about it
+func addTaskWithInfo(tx Tx, task Task) error {
+	val := []byte(task.URL)
 
-			return addTask(tx, val)
+	if err := addTask(tx, val); err != nil {
+		return err
+	}
+	// it could have been discovered before, deeper than we go
+	if err := tx.Delete(discoveredBucket, val); err != nil && !isNotFound(err) {
+		return err
+	}
+	return putTaskInfo(tx, taskBucket, task)
+}
+
+func (q *queue) AddTask(task Task) (err error) {
+	err = q.db.Update(
+		func(tx Tx) error {
+			return addTaskWithInfo(tx, task)
 		},
 	)
 	if err != nil {
@@ -116,23 +180,42 @@ func (q *queue) AddTask(value string) (err error) {
 	return nil
 }
 
-func getTask(tx *nutsdb.Tx) (val []byte, err error) {
+func getTask(tx Tx) (val []byte, err error) {
 	logger := settings.Get().Logger()
 
 	logger.Trace().Msg("getTask")
-	val, err = tx.LPop(listBucket, mainListKey)
+	// retries go first — they already waited for their turn
+	val, scheduled, err := popDueRetry(tx)
 	if err != nil {
-		// nutsdb.ErrRecordIsNil should be exported error, but it is not...
-		if err.Error() == "the record is nil" {
-			return val, nil
-		} else {
+		return nil, err
+	}
+	if val == nil {
+		val, err = tx.LPop(listBucket, mainListKey)
+		if err != nil {
 			logger.Debug().Err(err).Msg("LPop failed")
 			return nil, err
 		}
+		if val == nil {
+			if scheduled {
+				return nil, ErrOnlyScheduledTasks
+			}
+			return nil, nil
+		}
+		err = tx.SRem(setBucket, mainSetKey, val)
+		if err != nil {
+			logger.Debug().Err(err).Msg("SRem failed")
+			return nil, err
+		}
 	}
-	err = tx.SRem(setBucket, mainSetKey, val)
+	// instead of just forgetting the task, we lease it; if we die before it is
+	// marked as processed or failed, it will be requeued on the next start
+	leaseTime, err := time.Now().UTC().MarshalText()
 	if err != nil {
-		logger.Debug().Err(err).Msg("SRem failed")
+		return nil, err
+	}
+	err = tx.Put(leaseBucket, val, leaseTime)
+	if err != nil {
+		logger.Debug().Err(err).Msg("Put lease failed")
 		return nil, err
 	}
 
@@ -140,37 +223,57 @@ func getTask(tx *nutsdb.Tx) (val []byte, err error) {
 	return val, nil
 }
 
-func (q *queue) GetTask() (value string, err error) {
-	var val []byte
-	err = q.nutsDB.Update(
-		func(tx *nutsdb.Tx) error {
-			val, err = getTask(tx)
+// GetTask returns the next task; its URL is empty if the queue is empty.
+// Task info is kept after that, because the task can come back to the queue
+// (retries, leases, recrawl).
+func (q *queue) GetTask() (task Task, err error) {
+	err = q.db.Update(
+		func(tx Tx) error {
+			val, err := getTask(tx)
+			if err != nil || val == nil {
+				return err
+			}
+			task, err = getTaskInfo(tx, taskBucket, val)
 			return err
 		},
 	)
 	if err != nil {
-		return "", err
+		return Task{}, err
 	}
 
-	return string(val), nil
+	return task, nil
 }
 
-func (q *queue) IsInQueue(value string) (isExisting bool, err error) {
-	logger := settings.Get().Logger()
+// isInQueue tells if a task is waiting in the queue; waiting for a retry is
+// still being in the queue
+func isInQueue(tx Tx, val []byte) (bool, error) {
+	isExisting, err := tx.SIsMember(setBucket, mainSetKey, val)
+	if err != nil {
+		settings.Get().Logger().Debug().Err(err).Msg("SIsMember failed")
+		return false, err
+	}
+	if isExisting {
+		return true, nil
+	}
 
-	logger.Trace().Msg("IsInQueue")
+	_, err = tx.Get(retryBucket, val)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
 
-	err = q.nutsDB.Update(
-		func(tx *nutsdb.Tx) error {
-			val := []byte(value)
+	return true, nil
+}
 
-			isExisting, err = tx.SIsMember(setBucket, mainSetKey, val)
-			if err != nil && !errors.Is(err, nutsdb.ErrBucketNotFound) {
-				logger.Debug().Err(err).Msg("SIsMember failed")
-				return err
-			}
+func (q *queue) IsInQueue(value string) (isExisting bool, err error) {
+	settings.Get().Logger().Trace().Msg("IsInQueue")
 
-			return nil
+	err = q.db.View(
+		func(tx Tx) error {
+			isExisting, err = isInQueue(tx, []byte(value))
+			return err
 		},
 	)
 	if err != nil {
@@ -180,10 +283,54 @@ func (q *queue) IsInQueue(value string) (isExisting bool, err error) {
 	return
 }
 
+func isInProgress(tx Tx, val []byte) (bool, error) {
+	_, err := tx.Get(leaseBucket, val)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (q *queue) IsInProgress(value string) (inProgress bool, err error) {
+	err = q.db.View(
+		func(tx Tx) error {
+			inProgress, err = isInProgress(tx, []byte(value))
+			return err
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return inProgress, nil
+}
+
+// releaseLease removes the lease, if there is one
+func releaseLease(tx Tx, val []byte) error {
+	err := tx.Delete(leaseBucket, val)
+	if err != nil && !isNotFound(err) {
+		settings.Get().Logger().Debug().Err(err).Msg("Delete lease failed")
+		return err
+	}
+
+	return nil
+}
+
 func (q *queue) MarkAsProcessed(value string) (err error) {
-	err = q.nutsDB.Update(
-		func(tx *nutsdb.Tx) error {
+	err = q.db.Update(
+		func(tx Tx) error {
 			val := []byte(value)
+			if err := releaseLease(tx, val); err != nil {
+				return err
+			}
+			// if it took a few attempts, we do not need the counter anymore
+			if err := tx.Delete(attemptsBucket, val); err != nil && !isNotFound(err) {
+				return err
+			}
 			return tx.SAdd(setBucket, processedSetKey, val)
 		},
 	)
@@ -194,20 +341,184 @@ func (q *queue) MarkAsProcessed(value string) (err error) {
 	return nil
 }
 
-func (q *queue) IsProcessed(value string) (isProcessed bool, err error) {
-	err = q.nutsDB.View(
-		func(tx *nutsdb.Tx) error {
-			val := []byte(value)
-			isProcessed, err = tx.SIsMember(setBucket, processedSetKey, val)
-			return err
+// RequeueLeases puts the leased tasks, which were leased more than olderThan
+// ago, back to the head of the queue. Returns the number of requeued tasks.
+func (q *queue) RequeueLeases(olderThan time.Duration) (requeued int, err error) {
+	logger := settings.Get().Logger()
+
+	err = q.db.Update(
+		func(tx Tx) error {
+			entries, err := tx.GetAll(leaseBucket)
+			if err != nil {
+				if isNotFound(err) {
+					return nil
+				}
+				logger.Debug().Err(err).Msg("GetAll leases failed")
+				return err
+			}
+
+			deadline := time.Now().Add(-olderThan)
+			for _, entry := range entries {
+				var leaseTime time.Time
+				// broken lease is as good as expired
+				if err := leaseTime.UnmarshalText(entry.Value); err == nil && leaseTime.After(deadline) {
+					continue
+				}
+
+				if err := tx.Delete(leaseBucket, entry.Key); err != nil {
+					logger.Debug().Err(err).Msg("Delete lease failed")
+					return err
+				}
+				// it could be already queued again, if someone found it while
+				// it was in progress (and we did not check for that back then)
+				exists, err := tx.SIsMember(setBucket, mainSetKey, entry.Key)
+				if err != nil {
+					logger.Debug().Err(err).Msg("SIsMember failed")
+					return err
+				}
+				if exists {
+					continue
+				}
+				if err := tx.LPush(listBucket, mainListKey, entry.Key); err != nil {
+					logger.Debug().Err(err).Msg("LPush failed")
+					return err
+				}
+				if err := tx.SAdd(setBucket, mainSetKey, entry.Key); err != nil {
+					logger.Debug().Err(err).Msg("SAdd failed")
+					return err
+				}
+				requeued++
+			}
+
+			return nil
 		},
 	)
 	if err != nil {
-		if errors.Is(err, nutsdb.ErrBucketNotFound) {
+		return 0, err
+	}
+
+	return requeued, nil
+}
+
+// startRecrawlPass queues everything processed again; the crawl budgets are
+// per pass, so their usage starts over too
+func startRecrawlPass(tx Tx) (requeued int, err error) {
+	requeued, err = requeueProcessed(tx)
+	if err != nil || requeued == 0 {
+		return requeued, err
+	}
+
+	return requeued, tx.Delete(usageBucket, usageKey)
+}
+
+// requeueProcessed puts all the processed tasks back to the queue, for a new
+// recrawl pass. Returns the number of requeued tasks.
+func requeueProcessed(tx Tx) (requeued int, err error) {
+	members, err := tx.SMembers(setBucket, processedSetKey)
+	if err != nil {
+		if isNotFound(err) {
+			return 0, nil
+		}
+		settings.Get().Logger().Debug().Err(err).Msg("SMembers failed")
+		return 0, err
+	}
+
+	for _, val := range members {
+		if err := tx.SRem(setBucket, processedSetKey, val); err != nil {
+			return requeued, err
+		}
+		if err := addTask(tx, val); err != nil {
+			if errors.Is(err, ErrStringAlreadyInQueue) {
+				continue
+			}
+			return requeued, err
+		}
+		requeued++
+	}
+
+	return requeued, nil
+}
+
+// isProcessed tells whether we are done with a given task; tasks that failed
+// permanently and went to the dead letters count as processed too, otherwise
+// we would queue them again each time we see a link to them
+func isProcessed(tx Tx, val []byte) (bool, error) {
+	processed, err := tx.SIsMember(setBucket, processedSetKey, val)
+	if err != nil || processed {
+		return processed, err
+	}
+
+	_, err = tx.Get(deadLetterBucket, val)
+	if err != nil {
+		if isNotFound(err) {
 			return false, nil
 		}
 		return false, err
 	}
 
-	return isProcessed, nil
+	return true, nil
+}
+
+// IsProcessed tells whether we are done with a given task, see isProcessed
+func (q *queue) IsProcessed(value string) (processed bool, err error) {
+	err = q.db.View(
+		func(tx Tx) error {
+			processed, err = isProcessed(tx, []byte(value))
+			return err
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return processed, nil
+}
+
+// SetLastmods records the last modification times of documents, as reported
+// by the site (e.g., in a sitemap), all in one transaction
+func (q *queue) SetLastmods(lastmods map[string]time.Time) error {
+	if len(lastmods) == 0 {
+		return nil
+	}
+
+	return q.db.Update(
+		func(tx Tx) error {
+			for value, lastmod := range lastmods {
+				ts, err := lastmod.UTC().MarshalText()
+				if err != nil {
+					return err
+				}
+				if err := tx.Put(lastmodBucket, []byte(value), ts); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+}
+
+// Lastmod returns what SetLastmods saved, or zero time if there is nothing
+func (q *queue) Lastmod(value string) (lastmod time.Time, err error) {
+	err = q.db.View(
+		func(tx Tx) error {
+			entry, err := tx.Get(lastmodBucket, []byte(value))
+			if err != nil {
+				return err
+			}
+			return lastmod.UnmarshalText(entry.Value)
+		},
+	)
+	if err != nil {
+		if isNotFound(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+
+	return lastmod, nil
+}
+
+// isNotFound tells if the error means that there is no such key
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
 }
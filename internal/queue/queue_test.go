@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGetTask(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		q := &queue{db: store}
+
+		task, err := q.GetTask()
+		if err != nil || task.URL != "" {
+			t.Fatalf("GetTask of an empty queue: got %+v, %v", task, err)
+		}
+
+		for _, value := range []string{"https://example.com/a", "https://example.com/b"} {
+			if err := q.AddTask(Task{URL: value, Depth: 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		task, err = q.GetTask()
+		if err != nil || task.URL != "https://example.com/a" || task.Depth != 1 {
+			t.Fatalf("GetTask: got %+v, %v", task, err)
+		}
+		if inProgress, err := q.IsInProgress(task.URL); err != nil || !inProgress {
+			t.Errorf("the task is not leased: %v, %v", inProgress, err)
+		}
+		if err := q.MarkAsFailed(task.URL, "timeout", time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		// a due retry goes before the queue
+		task, err = q.GetTask()
+		if err != nil || task.URL != "https://example.com/b" {
+			t.Fatalf("GetTask: got %+v, %v", task, err)
+		}
+		if err := q.MarkAsFailed(task.URL, "timeout", time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		task, err = q.GetTask()
+		if err != nil || task.URL != "https://example.com/b" {
+			t.Fatalf("GetTask of a due retry: got %+v, %v", task, err)
+		}
+		if err := q.MarkAsProcessed(task.URL); err != nil {
+			t.Fatal(err)
+		}
+
+		// the workers wait for the retries instead of finishing
+		task, err = q.GetTask()
+		if !errors.Is(err, ErrOnlyScheduledTasks) {
+			t.Errorf("GetTask with only scheduled retries: got %+v, %v, expected ErrOnlyScheduledTasks", task, err)
+		}
+	})
+}
+
+func TestStartRecrawlPass(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store Store) {
+		q := &queue{db: store}
+		value := "https://example.com/"
+
+		if err := q.AddTask(Task{URL: value}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.GetTask(); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.MarkAsProcessed(value); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.AddUsage(1, 100, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+
+		var requeued int
+		update(t, store, func(tx Tx) (err error) {
+			requeued, err = startRecrawlPass(tx)
+			return err
+		})
+		if requeued != 1 {
+			t.Errorf("requeued %d tasks, expected 1", requeued)
+		}
+		if queued, err := q.IsInQueue(value); err != nil || !queued {
+			t.Errorf("processed task is not queued again: %v, %v", queued, err)
+		}
+		// otherwise the new pass would stop right away, with the budget of
+		// the previous one used up
+		if usage, err := q.Usage(); err != nil || usage != (Usage{}) {
+			t.Errorf("usage is not reset: %+v, %v", usage, err)
+		}
+	})
+}
@@ -0,0 +1,249 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+// failed tasks are either scheduled for a retry, or, when the crawler gives up
+// on them, moved to the dead letters. when to give up and how long to wait is
+// decided by the crawler; here we just keep track of things.
+
+const (
+	// url -> number of failed attempts so far
+	attemptsBucket string = "crawlerAttempts"
+	// url -> time of the next attempt
+	retryBucket string = "crawlerRetries"
+	// url -> DeadLetter
+	deadLetterBucket string = "crawlerDeadLetters"
+)
+
+// DeadLetter is a task we gave up on
+type DeadLetter struct {
+	URL      string    `json:"url"`
+	Reason   string    `json:"reason"`
+	Attempts int       `json:"attempts"`
+	At       time.Time `json:"at"`
+}
+
+func getAttempts(tx Tx, val []byte) (int, error) {
+	entry, err := tx.Get(attemptsBucket, val)
+	if err != nil {
+		if isNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return strconv.Atoi(string(entry.Value))
+}
+
+// Attempts returns the number of failed attempts of a given task
+func (q *queue) Attempts(value string) (attempts int, err error) {
+	err = q.db.View(
+		func(tx Tx) error {
+			attempts, err = getAttempts(tx, []byte(value))
+			return err
+		},
+	)
+
+	return attempts, err
+}
+
+// MarkAsFailed releases the task lease and counts the failed attempt. If
+// retryAt is set, the task will be given out by GetTask again after that time;
+// otherwise, it is moved to the dead letters with a given reason.
+func (q *queue) MarkAsFailed(value, reason string, retryAt time.Time) error {
+	logger := settings.Get().Logger()
+
+	return q.db.Update(
+		func(tx Tx) error {
+			val := []byte(value)
+			if err := releaseLease(tx, val); err != nil {
+				return err
+			}
+
+			attempts, err := getAttempts(tx, val)
+			if err != nil {
+				logger.Debug().Err(err).Msg("getAttempts failed")
+				return err
+			}
+			attempts++
+
+			if !retryAt.IsZero() {
+				logger.Debug().Str("val", value).Int("attempts", attempts).Time("retryAt", retryAt).Msg("scheduling a retry")
+				ts, err := retryAt.UTC().MarshalText()
+				if err != nil {
+					return err
+				}
+				if err := tx.Put(retryBucket, val, ts); err != nil {
+					logger.Debug().Err(err).Msg("Put retry failed")
+					return err
+				}
+				return tx.Put(attemptsBucket, val, []byte(strconv.Itoa(attempts)))
+			}
+
+			logger.Debug().Str("val", value).Int("attempts", attempts).Msg("moving to dead letters")
+			deadLetter, err := json.Marshal(DeadLetter{
+				URL:      value,
+				Reason:   reason,
+				Attempts: attempts,
+				At:       time.Now().UTC(),
+			})
+			if err != nil {
+				return err
+			}
+			if err := tx.Put(deadLetterBucket, val, deadLetter); err != nil {
+				logger.Debug().Err(err).Msg("Put dead letter failed")
+				return err
+			}
+			if err := tx.Delete(attemptsBucket, val); err != nil && !isNotFound(err) {
+				return err
+			}
+
+			return nil
+		},
+	)
+}
+
+// popDueRetry takes the task with the earliest retry time that has already
+// come, if any. Also, it tells if there are any retries scheduled at all.
+// That is a full scan of retries, which is fine as long as there are not too
+// many of them — and if there are, the site is probably down anyway.
+func popDueRetry(tx Tx) (val []byte, scheduled bool, err error) {
+	entries, err := tx.GetAll(retryBucket)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, false, nil
+		}
+		settings.Get().Logger().Debug().Err(err).Msg("GetAll retries failed")
+		return nil, false, err
+	}
+
+	now := time.Now()
+	var earliest time.Time
+	for _, entry := range entries {
+		var retryAt time.Time
+		if err := retryAt.UnmarshalText(entry.Value); err != nil {
+			// broken entry, let's just retry it right away
+			retryAt = now
+		}
+		scheduled = true
+		if retryAt.After(now) {
+			continue
+		}
+		if val == nil || retryAt.Before(earliest) {
+			val, earliest = entry.Key, retryAt
+		}
+	}
+	if val == nil {
+		return nil, scheduled, nil
+	}
+
+	if err := tx.Delete(retryBucket, val); err != nil {
+		return nil, scheduled, err
+	}
+
+	return val, scheduled, nil
+}
+
+func hasScheduledRetries(tx Tx) (bool, error) {
+	entries, err := tx.GetAll(retryBucket)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return len(entries) > 0, nil
+}
+
+// DeadLetters lists the tasks we gave up on
+func (q *queue) DeadLetters() (deadLetters []DeadLetter, err error) {
+	err = q.db.View(
+		func(tx Tx) error {
+			entries, err := tx.GetAll(deadLetterBucket)
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				var deadLetter DeadLetter
+				if err := json.Unmarshal(entry.Value, &deadLetter); err != nil {
+					deadLetter = DeadLetter{URL: string(entry.Key), Reason: "broken dead letter record"}
+				}
+				deadLetters = append(deadLetters, deadLetter)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return deadLetters, nil
+}
+
+// RequeueDeadLetters puts given dead tasks (or all of them, if none are given)
+// back to the queue, with a fresh attempts counter
+func (q *queue) RequeueDeadLetters(values ...string) (requeued int, err error) {
+	logger := settings.Get().Logger()
+
+	err = q.db.Update(
+		func(tx Tx) error {
+			var keys [][]byte
+			if len(values) > 0 {
+				for _, value := range values {
+					keys = append(keys, []byte(value))
+				}
+			} else {
+				entries, err := tx.GetAll(deadLetterBucket)
+				if err != nil {
+					if isNotFound(err) {
+						return nil
+					}
+					return err
+				}
+				for _, entry := range entries {
+					keys = append(keys, entry.Key)
+				}
+			}
+
+			for _, key := range keys {
+				if _, err := tx.Get(deadLetterBucket, key); err != nil {
+					if isNotFound(err) {
+						logger.Warn().Str("val", string(key)).Msg("there is no such dead letter")
+						continue
+					}
+					return err
+				}
+				if err := tx.Delete(deadLetterBucket, key); err != nil {
+					return err
+				}
+				if err := addTask(tx, key); err != nil {
+					if errors.Is(err, ErrStringAlreadyInQueue) {
+						continue
+					}
+					return err
+				}
+				requeued++
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return requeued, nil
+}
@@ -0,0 +1,108 @@
+package queue
+
+import (
+	"encoding/json"
+)
+
+// the list and the sets hold bare URLs (that is what all the deduplication is
+// based on), and everything else we know about a task is kept aside
+
+const (
+	// url -> taskInfo
+	taskBucket string = "crawlerTasks"
+	// url -> taskInfo, for the links we found, but did not follow (see
+	// --max-depth)
+	discoveredBucket string = "crawlerDiscovered"
+)
+
+// Task is what the crawler gets from the queue
+type Task struct {
+	URL string
+	// number of hops from the starting URL; it is zero for the starting URL,
+	// and for tasks queued before we started to track it
+	Depth int
+	// URL of the document where we found this one; empty for the starting URL
+	Referrer string
+}
+
+type taskInfo struct {
+	Depth    int    `json:"depth"`
+	Referrer string `json:"referrer,omitempty"`
+}
+
+func putTaskInfo(tx Tx, bucket string, task Task) error {
+	encoded, err := json.Marshal(taskInfo{Depth: task.Depth, Referrer: task.Referrer})
+	if err != nil {
+		return err
+	}
+
+	return tx.Put(bucket, []byte(task.URL), encoded)
+}
+
+// getTaskInfo fills in what we know about the task with a given URL
+func getTaskInfo(tx Tx, bucket string, val []byte) (task Task, err error) {
+	task.URL = string(val)
+	entry, err := tx.Get(bucket, val)
+	if err != nil {
+		if isNotFound(err) {
+			return task, nil
+		}
+		return task, err
+	}
+
+	var info taskInfo
+	if err := json.Unmarshal(entry.Value, &info); err != nil {
+		// that is not worth losing the task
+		return task, nil
+	}
+	task.Depth, task.Referrer = info.Depth, info.Referrer
+
+	return task, nil
+}
+
+// addDiscovered records a link we have found, but decided not to follow
+func addDiscovered(tx Tx, task Task) error {
+	// the first time we found it is as good as any
+	if _, err := tx.Get(discoveredBucket, []byte(task.URL)); err == nil {
+		return nil
+	} else if !isNotFound(err) {
+		return err
+	}
+	return putTaskInfo(tx, discoveredBucket, task)
+}
+
+// AddDiscovered records a link we have found, but decided not to follow
+func (q *queue) AddDiscovered(task Task) error {
+	return q.db.Update(
+		func(tx Tx) error {
+			return addDiscovered(tx, task)
+		},
+	)
+}
+
+// Discovered lists the links we have found, but decided not to follow
+func (q *queue) Discovered() (tasks []Task, err error) {
+	err = q.db.View(
+		func(tx Tx) error {
+			entries, err := tx.GetAll(discoveredBucket)
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				task, err := getTaskInfo(tx, discoveredBucket, entry.Key)
+				if err != nil {
+					return err
+				}
+				tasks = append(tasks, task)
+			}
+
+			return nil
+		},
+	)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+
+	return tasks, nil
+}
@@ -0,0 +1,75 @@
+package queue
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// how much of the crawl budgets (see --max-pages and friends) is used; it is
+// kept here, so the budgets survive resume. a new --recrawl pass starts from
+// zero (see startRecrawlPass)
+
+const (
+	usageBucket string = "crawlerUsage"
+)
+
+var usageKey = []byte("usage")
+
+type Usage struct {
+	Pages int64 `json:"pages"`
+	Bytes int64 `json:"bytes"`
+	// time spent crawling, in all the runs together
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+func getUsage(tx Tx) (usage Usage, err error) {
+	entry, err := tx.Get(usageBucket, usageKey)
+	if err != nil {
+		if isNotFound(err) {
+			return Usage{}, nil
+		}
+		return Usage{}, err
+	}
+	// broken record is not a reason to stop crawling
+	_ = json.Unmarshal(entry.Value, &usage)
+
+	return usage, nil
+}
+
+// Usage returns the budget usage so far
+func (q *queue) Usage() (usage Usage, err error) {
+	err = q.db.View(
+		func(tx Tx) error {
+			usage, err = getUsage(tx)
+			return err
+		},
+	)
+
+	return usage, err
+}
+
+// AddUsage adds pages and bytes to the usage, and updates the elapsed time
+// (unless it is smaller than the saved one). Returns the updated usage.
+func (q *queue) AddUsage(pages, bytes int64, elapsed time.Duration) (usage Usage, err error) {
+	err = q.db.Update(
+		func(tx Tx) error {
+			usage, err = getUsage(tx)
+			if err != nil {
+				return err
+			}
+			usage.Pages += pages
+			usage.Bytes += bytes
+			if elapsed > usage.Elapsed {
+				usage.Elapsed = elapsed
+			}
+
+			encoded, err := json.Marshal(usage)
+			if err != nil {
+				return err
+			}
+			return tx.Put(usageBucket, usageKey, encoded)
+		},
+	)
+
+	return usage, err
+}
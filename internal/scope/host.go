@@ -0,0 +1,129 @@
+package scope
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// host policies decide which hosts the crawler goes to:
+//   - exact: only the host of the starting URL
+//   - www: the host of the starting URL, with or without "www." (that is how
+//     the crawler always worked, so it is the default)
+//   - domain: all the subdomains of the registrable domain of the starting
+//     URL (for blog.example.co.uk that is example.co.uk and *.example.co.uk)
+//
+// also, extra hosts can be allowed explicitly; "*.example.com" allows all the
+// subdomains of example.com (but not example.com itself).
+
+const (
+	HostPolicyExact  = "exact"
+	HostPolicyWWW    = "www"
+	HostPolicyDomain = "domain"
+)
+
+type HostPolicy struct {
+	policy string
+	// hosts are compared in their ASCII (punycode) form, with non-default ports
+	startHost   string
+	startDomain string
+	extraHosts  []string
+}
+
+func NewHostPolicy(policy string, startUrlObject *url.URL, extraHosts []string) (*HostPolicy, error) {
+	hp := &HostPolicy{policy: policy}
+
+	var err error
+	hp.startHost, err = hostKey(startUrlObject.Scheme, startUrlObject.Host)
+	if err != nil {
+		return nil, err
+	}
+	switch policy {
+	case HostPolicyExact:
+	case HostPolicyWWW:
+		hp.startHost = strings.TrimPrefix(hp.startHost, "www.")
+	case HostPolicyDomain:
+		hp.startDomain, err = publicsuffix.EffectiveTLDPlusOne(startUrlObject.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("can't get registrable domain of %s: %w", startUrlObject.Hostname(), err)
+		}
+		if hp.startDomain, err = idna.Lookup.ToASCII(hp.startDomain); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown host policy %q (must be one of exact, www, domain)", policy)
+	}
+
+	for _, extraHost := range extraHosts {
+		wildcard := strings.HasPrefix(extraHost, "*.")
+		key, err := hostKey(startUrlObject.Scheme, strings.TrimPrefix(extraHost, "*."))
+		if err != nil {
+			return nil, fmt.Errorf("bad host %q: %w", extraHost, err)
+		}
+		if wildcard {
+			key = "." + key
+		}
+		hp.extraHosts = append(hp.extraHosts, key)
+	}
+
+	return hp, nil
+}
+
+// hostKey lowercases the host, converts it to ASCII, and drops the default port
+func hostKey(scheme, host string) (string, error) {
+	hostname, port := host, ""
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		hostname, port = host[:i], host[i+1:]
+	}
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+
+	hostname, err := idna.Lookup.ToASCII(strings.ToLower(hostname))
+	if err != nil {
+		return "", err
+	}
+	if len(port) > 0 {
+		return hostname + ":" + port, nil
+	}
+	return hostname, nil
+}
+
+// Allows tells if the crawler can go to the host of a given URL
+func (hp *HostPolicy) Allows(urlObject *url.URL) bool {
+	key, err := hostKey(urlObject.Scheme, urlObject.Host)
+	if err != nil {
+		return false
+	}
+
+	for _, extraHost := range hp.extraHosts {
+		if key == extraHost || (strings.HasPrefix(extraHost, ".") && strings.HasSuffix(key, extraHost)) {
+			return true
+		}
+	}
+
+	switch hp.policy {
+	case HostPolicyExact:
+		return key == hp.startHost
+	case HostPolicyWWW:
+		return strings.TrimPrefix(key, "www.") == hp.startHost
+	case HostPolicyDomain:
+		// ports do not matter here, like they do not matter for cookies
+		hostname := key
+		if i := strings.LastIndex(hostname, ":"); i >= 0 && !strings.HasSuffix(hostname, "]") {
+			hostname = hostname[:i]
+		}
+		return hostname == hp.startDomain || strings.HasSuffix(hostname, "."+hp.startDomain)
+	}
+
+	return false
+}
+
+// MultiHost tells if the crawler can go to really different hosts (and not
+// just www. and non-www. versions of the same one)
+func (hp *HostPolicy) MultiHost() bool {
+	return hp.policy == HostPolicyDomain || len(hp.extraHosts) > 0
+}
@@ -0,0 +1,194 @@
+package scope
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// scope rules decide which of the found links we follow. there are three
+// kinds of them:
+//   - prefix: the URL starts with a given string
+//   - glob: the URL matches a given pattern, where * matches any sequence of
+//     characters (slashes included), and ? matches any single character
+//   - regex: the URL contains a match of a given regular expression
+//
+// prefixes and globs starting with "/" are matched against the path with the
+// query (e.g., "/docs/page?x=1"), the others — against the whole URL. regexes
+// are always matched against the whole URL.
+//
+// a URL is in scope if it does not match any exclude rule, and matches at
+// least one include rule (if there are any).
+
+const (
+	KindPrefix = "prefix"
+	KindGlob   = "glob"
+	KindRegex  = "regex"
+)
+
+type Rule struct {
+	Include bool
+	Kind    string
+	Pattern string
+	re      *regexp.Regexp
+}
+
+// ParseRule parses a rule in the "kind:pattern" form, e.g. "prefix:/docs/"
+func ParseRule(include bool, spec string) (Rule, error) {
+	kind, pattern, ok := strings.Cut(spec, ":")
+	if !ok || len(pattern) == 0 {
+		return Rule{}, fmt.Errorf("rule %q must look like kind:pattern", spec)
+	}
+
+	rule := Rule{Include: include, Kind: kind, Pattern: pattern}
+	var err error
+	switch kind {
+	case KindPrefix:
+	case KindGlob:
+		rule.re, err = globToRegexp(pattern)
+	case KindRegex:
+		rule.re, err = regexp.Compile(pattern)
+	default:
+		return Rule{}, fmt.Errorf("rule %q has unknown kind %q (must be one of prefix, glob, regex)", spec, kind)
+	}
+	if err != nil {
+		return Rule{}, fmt.Errorf("rule %q is invalid: %w", spec, err)
+	}
+
+	return rule, nil
+}
+
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, char := range glob {
+		switch char {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	expr.WriteString("$")
+
+	return regexp.Compile(expr.String())
+}
+
+func (r Rule) String() string {
+	action := "exclude"
+	if r.Include {
+		action = "include"
+	}
+	return action + " " + r.Kind + ":" + r.Pattern
+}
+
+// Matches tells if the rule matches a given URL
+func (r Rule) Matches(urlObject *url.URL) bool {
+	subject := urlObject.String()
+	if r.Kind != KindRegex && strings.HasPrefix(r.Pattern, "/") {
+		subject = urlObject.RequestURI()
+	}
+
+	if r.Kind == KindPrefix {
+		return strings.HasPrefix(subject, r.Pattern)
+	}
+	return r.re.MatchString(subject)
+}
+
+// LoadRules reads the rules from a file. Each line is "include <rule>" or
+// "exclude <rule>"; empty lines and lines starting with # are skipped.
+func LoadRules(path string) (rules []Rule, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		action, spec, _ := strings.Cut(line, " ")
+		spec = strings.TrimSpace(spec)
+		var rule Rule
+		switch action {
+		case "include", "exclude":
+			rule, err = ParseRule(action == "include", spec)
+		default:
+			err = fmt.Errorf("line must start with include or exclude")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+type Filter struct {
+	includes []Rule
+	excludes []Rule
+}
+
+// Decision is what the filter thinks about a URL, and why
+type Decision struct {
+	InScope bool
+	// the rule that decided it; nil if no rule matched
+	Rule *Rule
+}
+
+func NewFilter(rules []Rule) *Filter {
+	f := &Filter{}
+	for _, rule := range rules {
+		if rule.Include {
+			f.includes = append(f.includes, rule)
+		} else {
+			f.excludes = append(f.excludes, rule)
+		}
+	}
+	return f
+}
+
+// Check decides if a URL is in scope
+func (f *Filter) Check(urlObject *url.URL) Decision {
+	for i := range f.excludes {
+		if f.excludes[i].Matches(urlObject) {
+			return Decision{InScope: false, Rule: &f.excludes[i]}
+		}
+	}
+	for i := range f.includes {
+		if f.includes[i].Matches(urlObject) {
+			return Decision{InScope: true, Rule: &f.includes[i]}
+		}
+	}
+
+	return Decision{InScope: len(f.includes) == 0}
+}
+
+func (d Decision) String() string {
+	verdict := "out of scope"
+	if d.InScope {
+		verdict = "in scope"
+	}
+	switch {
+	case d.Rule != nil:
+		return verdict + ", matched rule: " + d.Rule.String()
+	case d.InScope:
+		return verdict + ", no rules matched"
+	default:
+		return verdict + ", no include rules matched"
+	}
+}
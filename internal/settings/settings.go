@@ -2,16 +2,70 @@ package settings
 
 import (
 	"net/url"
+	"time"
 
 	"github.com/rs/zerolog"
+
+	"github.com/skaurus/ta-site-crawler/internal/scope"
 )
 
+// Params holds everything the Save accepts. There are too many settings now
+// to pass them to Save positionally, and it is too easy to mix up two bools.
+type Params struct {
+	URL          *url.URL
+	OutputDir    string
+	WorkersCnt   uint8
+	Logger       *zerolog.Logger
+	HTTPTimeout  uint16
+	UserAgent    string
+	IgnoreRobots bool
+	SkipSitemaps bool
+	// how many times we try to download a document before giving up on it
+	RetryMaxAttempts uint8
+	RetryBaseDelay   time.Duration
+	RetryMaxDelay    time.Duration
+	// transport errors are always retried, and non-2xx statuses only if they
+	// are in this list
+	RetryStatuses []int
+	// politeness settings, applied per host
+	RequestsPerSecond     float64
+	MaxConnectionsPerHost uint8
+	AdaptiveThrottling    bool
+	// rewrite links in the downloaded documents for offline browsing
+	ConvertLinks bool
+	// where the documents go: file tree, WARC files, or both
+	OutputFormat string
+	// WARC files are rotated when they get bigger than that, in bytes
+	WARCMaxSize int64
+	// revisit the processed urls and refresh the changed documents
+	Recrawl bool
+	// links deeper than that (in hops from the starting url) are not
+	// followed; zero means no limit
+	MaxDepth uint16
+	// include/exclude rules for the found links
+	Scope *scope.Filter
+	// which hosts we go to
+	HostPolicy *scope.HostPolicy
+	// skip the documents that declare another URL as canonical
+	HonorCanonical bool
+	// crawl budgets; zero means no limit
+	MaxPages    uint32
+	MaxBytes    int64
+	MaxDuration time.Duration
+	// documents bigger than that are skipped or truncated, in bytes
+	MaxDocumentSize int64
+	// content-types of the documents we save -> file extensions for them
+	ContentTypes map[string]string
+	// store HTML and CSS documents converted to UTF-8
+	TranscodeUTF8 bool
+	// how many redirects we follow for a single request; zero means none
+	MaxRedirects uint8
+	// where the queue keeps its data, see queue.Backends()
+	QueueBackend string
+}
+
 type settings struct {
-	urlObject   *url.URL
-	outputDir   string
-	workersCnt  uint8
-	logger      *zerolog.Logger
-	httpTimeout uint16
+	p Params
 }
 
 type Settings interface {
@@ -20,6 +74,32 @@ type Settings interface {
 	WorkersCnt() uint8
 	Logger() *zerolog.Logger
 	HTTPTimeout() uint16
+	UserAgent() string
+	IgnoreRobots() bool
+	SkipSitemaps() bool
+	RetryMaxAttempts() uint8
+	RetryBaseDelay() time.Duration
+	RetryMaxDelay() time.Duration
+	RetryStatuses() []int
+	RequestsPerSecond() float64
+	MaxConnectionsPerHost() uint8
+	AdaptiveThrottling() bool
+	ConvertLinks() bool
+	OutputFormat() string
+	WARCMaxSize() int64
+	Recrawl() bool
+	MaxDepth() uint16
+	Scope() *scope.Filter
+	HostPolicy() *scope.HostPolicy
+	HonorCanonical() bool
+	MaxPages() uint32
+	MaxBytes() int64
+	MaxDuration() time.Duration
+	MaxDocumentSize() int64
+	ContentTypes() map[string]string
+	TranscodeUTF8() bool
+	MaxRedirects() uint8
+	QueueBackend() string
 }
 
 var settingsInstance Settings
@@ -29,19 +109,18 @@ const (
 	FilePermissions = 0644
 	CrawlingDir     = "crawled"
 	RootFilename    = "_index"
+	WARCDir         = "warc"
+
+	OutputFormatFiles = "files"
+	OutputFormatWARC  = "warc"
+	OutputFormatBoth  = "both"
 )
 
 // Save saves settings to singleton instance; also it kinda works as a getter,
 // if someone tries to call it again.
-func Save(urlObject *url.URL, outputDir string, workersCnt uint8, logger *zerolog.Logger, httpTimeout uint16) Settings {
+func Save(p Params) Settings {
 	if settingsInstance == nil {
-		settingsInstance = &settings{
-			urlObject:   urlObject,
-			outputDir:   outputDir,
-			workersCnt:  workersCnt,
-			logger:      logger,
-			httpTimeout: httpTimeout,
-		}
+		settingsInstance = &settings{p: p}
 	} else {
 		settingsInstance.Logger().Error().Msg("settings were already saved, returning existing instance")
 	}
@@ -57,21 +136,133 @@ func Get() Settings {
 }
 
 func (s *settings) URL() *url.URL {
-	return s.urlObject
+	return s.p.URL
 }
 
 func (s *settings) OutputDir() string {
-	return s.outputDir
+	return s.p.OutputDir
 }
 
 func (s *settings) WorkersCnt() uint8 {
-	return s.workersCnt
+	return s.p.WorkersCnt
 }
 
 func (s *settings) Logger() *zerolog.Logger {
-	return s.logger
+	return s.p.Logger
 }
 
 func (s *settings) HTTPTimeout() uint16 {
-	return s.httpTimeout
+	return s.p.HTTPTimeout
+}
+
+// UserAgent is sent as the User-Agent header, and its product token (the part
+// before the first slash) is what we look for in robots.txt
+func (s *settings) UserAgent() string {
+	return s.p.UserAgent
+}
+
+func (s *settings) IgnoreRobots() bool {
+	return s.p.IgnoreRobots
+}
+
+func (s *settings) SkipSitemaps() bool {
+	return s.p.SkipSitemaps
+}
+
+func (s *settings) RetryMaxAttempts() uint8 {
+	return s.p.RetryMaxAttempts
+}
+
+func (s *settings) RetryBaseDelay() time.Duration {
+	return s.p.RetryBaseDelay
+}
+
+func (s *settings) RetryMaxDelay() time.Duration {
+	return s.p.RetryMaxDelay
+}
+
+func (s *settings) RetryStatuses() []int {
+	return s.p.RetryStatuses
+}
+
+// RequestsPerSecond is zero if there is no limit
+func (s *settings) RequestsPerSecond() float64 {
+	return s.p.RequestsPerSecond
+}
+
+func (s *settings) MaxConnectionsPerHost() uint8 {
+	return s.p.MaxConnectionsPerHost
+}
+
+func (s *settings) AdaptiveThrottling() bool {
+	return s.p.AdaptiveThrottling
+}
+
+func (s *settings) ConvertLinks() bool {
+	return s.p.ConvertLinks
+}
+
+// OutputFormat is one of OutputFormatFiles, OutputFormatWARC, OutputFormatBoth
+func (s *settings) OutputFormat() string {
+	return s.p.OutputFormat
+}
+
+func (s *settings) WARCMaxSize() int64 {
+	return s.p.WARCMaxSize
+}
+
+func (s *settings) Recrawl() bool {
+	return s.p.Recrawl
+}
+
+// MaxDepth is zero if there is no limit
+func (s *settings) MaxDepth() uint16 {
+	return s.p.MaxDepth
+}
+
+func (s *settings) Scope() *scope.Filter {
+	return s.p.Scope
+}
+
+func (s *settings) HostPolicy() *scope.HostPolicy {
+	return s.p.HostPolicy
+}
+
+func (s *settings) HonorCanonical() bool {
+	return s.p.HonorCanonical
+}
+
+// MaxPages, MaxBytes and MaxDuration are zero if there is no limit
+func (s *settings) MaxPages() uint32 {
+	return s.p.MaxPages
+}
+
+func (s *settings) MaxBytes() int64 {
+	return s.p.MaxBytes
+}
+
+func (s *settings) MaxDuration() time.Duration {
+	return s.p.MaxDuration
+}
+
+func (s *settings) MaxDocumentSize() int64 {
+	return s.p.MaxDocumentSize
+}
+
+// ContentTypes maps the accepted content-types to file extensions (without
+// the dot); documents of other types are not saved
+func (s *settings) ContentTypes() map[string]string {
+	return s.p.ContentTypes
+}
+
+func (s *settings) TranscodeUTF8() bool {
+	return s.p.TranscodeUTF8
+}
+
+func (s *settings) MaxRedirects() uint8 {
+	return s.p.MaxRedirects
+}
+
+func (s *settings) QueueBackend() string {
+	return s.p.QueueBackend
 }
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/PuerkitoBio/purell"
+)
+
+// Canonicalization tells NormalizeUrlObject how far to go. The same page is
+// often linked with different tracking parameters, session ids, or parameters
+// in a different order; without canonicalization each of those would be
+// crawled and saved as a separate document.
+type Canonicalization struct {
+	// names of query (and path, like ;jsessionid=...) parameters to remove;
+	// * matches any sequence of characters, names are case-insensitive
+	StripParams    []string
+	SortParams     bool
+	DropFragments  bool
+	LowercasePaths bool
+}
+
+// it is set once on start, before any URL is normalized, so there is no
+// need for locking
+var canonicalization Canonicalization
+
+// SetCanonicalization must be called before the first NormalizeUrlObject call
+// (the starting URL is normalized too)
+func SetCanonicalization(c Canonicalization) {
+	for i, param := range c.StripParams {
+		c.StripParams[i] = strings.ToLower(param)
+	}
+	canonicalization = c
+}
+
+func isStrippedParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range canonicalization.StripParams {
+		if matched, err := path.Match(pattern, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// stripQueryParams removes the stripped parameters from a raw query, keeping
+// the order (and encoding) of the others
+func stripQueryParams(rawQuery string) string {
+	if len(rawQuery) == 0 {
+		return rawQuery
+	}
+	pairs := strings.Split(rawQuery, "&")
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		name, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !isStrippedParam(name) {
+			kept = append(kept, pair)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// stripPathParams removes the stripped parameters from path segments, like
+// ;jsessionid=... in /page;jsessionid=123
+func stripPathParams(urlPath string) string {
+	if !strings.Contains(urlPath, ";") {
+		return urlPath
+	}
+	segments := strings.Split(urlPath, "/")
+	for i, segment := range segments {
+		parts := strings.Split(segment, ";")
+		kept := parts[:1]
+		for _, part := range parts[1:] {
+			name, _, _ := strings.Cut(part, "=")
+			if !isStrippedParam(name) {
+				kept = append(kept, part)
+			}
+		}
+		segments[i] = strings.Join(kept, ";")
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalize(urlObject *url.URL) (*url.URL, purell.NormalizationFlags) {
+	flags := purell.FlagsSafe
+	if canonicalization.SortParams {
+		flags |= purell.FlagSortQuery
+	}
+	if canonicalization.DropFragments {
+		flags |= purell.FlagRemoveFragment
+	}
+
+	// purell changes the object it is given, and it is not ours
+	copied := *urlObject
+	if len(canonicalization.StripParams) > 0 {
+		copied.RawQuery = stripQueryParams(copied.RawQuery)
+		if strippedPath := stripPathParams(copied.Path); strippedPath != copied.Path {
+			copied.Path, copied.RawPath = strippedPath, ""
+		}
+	}
+	if canonicalization.LowercasePaths {
+		copied.Path, copied.RawPath = strings.ToLower(copied.Path), strings.ToLower(copied.RawPath)
+	}
+
+	return &copied, flags
+}
@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"runtime"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/exp/maps"
+
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+// URL path segments go to the filesystem as file and folder names, and they
+// can be anything: "..", NUL bytes, names longer than a filesystem allows,
+// names of our own temp and marker files. so each of them is encoded:
+//   - bytes that are unsafe or meaningless in a name are percent-encoded,
+//     "%" itself included — so "%XX" in a name is always ours;
+//   - "." and ".." become "%2E" and "%2E%2E", and can't escape the crawling dir;
+//   - folders have their dots encoded too. files always have a dot (we add an
+//     extension if there is none), so a file and a folder never share a name,
+//     whatever URLs we meet and in whatever order (think /a.html and /a.html/b);
+//   - names of our temp files (*.temp) and root documents (_index) are escaped;
+//   - too long names are cut, and get a hash of the full name.
+// the result is not meant to be decoded; queue keeps the path -> URL mapping.
+//
+// Windows (NTFS, and FAT on USB drives) is pickier than that: it does not take
+// <>:"\|?* in names, nor names ending with a dot or a space, nor device names
+// like CON or NUL.txt, and it does not tell "A" from "a". with the windows-safe
+// naming those are encoded too, so a crawl tree can be made on Linux and then
+// copied to Windows. it is the default on Windows, of course.
+
+// most filesystems allow 255 bytes in a name, and we need some room for the
+// extension we add, and for the temp file suffixes
+const maxComponentLength = 200
+
+const (
+	PathNamingPOSIX       = "posix"
+	PathNamingWindowsSafe = "windows-safe"
+)
+
+// it is set once on start, before any path is made, so there is no need for
+// locking
+var windowsSafe = runtime.GOOS == "windows"
+
+var windowsDeviceNames = map[string]struct{}{
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM0": {}, "COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {}, "COM6": {}, "COM7": {}, "COM8": {}, "COM9": {},
+	"COM¹": {}, "COM²": {}, "COM³": {},
+	"LPT0": {}, "LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {}, "LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+	"LPT¹": {}, "LPT²": {}, "LPT³": {},
+}
+
+// DefaultPathNaming is the naming that suits the OS we run on
+func DefaultPathNaming() string {
+	if runtime.GOOS == "windows" {
+		return PathNamingWindowsSafe
+	}
+	return PathNamingPOSIX
+}
+
+// SetPathNaming must be called before the first path is made (the output
+// folder of the site included); naming is one of PathNaming* constants
+func SetPathNaming(naming string) {
+	windowsSafe = naming == PathNamingWindowsSafe
+}
+
+// PathKey returns what tells one file path from another on the filesystems we
+// make the paths for; paths with the same key are the same file
+func PathKey(path string) string {
+	if windowsSafe {
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// UrlToFileStructure converts URL path to a file path and name; path uses
+// forward slashes, and is always inside the folder it is relative to
+func UrlToFileStructure(urlObject *url.URL) (path, filename string) {
+	// path could be empty, filename could be empty as well (e.g., https://example.com/
+	// or https://example.com/path/), but we will handle it
+	urlPath := strings.TrimPrefix(strings.TrimSuffix(urlObject.Path, "/"), "/")
+	urlPathElements := strings.Split(urlPath, "/")
+	filename = urlPathElements[len(urlPathElements)-1]
+
+	// also, we need to make unique filenames for different sets of GET parameters
+	var params = urlObject.Query()
+	sortedParamNames := maps.Keys(params)
+	slices.Sort(sortedParamNames)
+	paramStrings := make([]string, 0, len(sortedParamNames))
+	for _, paramName := range sortedParamNames {
+		paramValues := params[paramName]
+		paramStrings = append(paramStrings, fmt.Sprintf("%s-%s", paramName, strings.Join(paramValues, "-")))
+	}
+
+	if len(filename) == 0 {
+		// we have possible filename collisions here (different documents served
+		// from /, /_index (with, say, content-type text/html), /_index.html).
+		// that is why names starting with `_index` are escaped when they come
+		// from URLs (see reserveName)
+		filename = settings.RootFilename
+	} else {
+		filename = encodeComponent(filename, false)
+	}
+	if len(paramStrings) > 0 {
+		filename = fmt.Sprintf("%s__%s", filename, encodeComponent(strings.Join(paramStrings, "_"), false))
+	}
+	filename = shortenComponent(filename)
+
+	folders := urlPathElements[:len(urlPathElements)-1]
+	for i, folder := range folders {
+		folders[i] = shortenComponent(encodeComponent(folder, true))
+	}
+	path = strings.Join(folders, "/")
+
+	return
+}
+
+// encodeComponent makes a file (or folder) name out of a URL path segment
+func encodeComponent(segment string, isFolder bool) string {
+	if len(segment) == 0 {
+		// a lone "%" can't come from the encoding below; that is for "//"
+		return "%"
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(segment); {
+		r, size := utf8.DecodeRuneInString(segment[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			// not all filesystems take names that are not valid UTF-8
+			fmt.Fprintf(&b, "%%%02X", segment[i])
+		case r < 0x20 || r == 0x7f || r == '%' || r == '/':
+			fmt.Fprintf(&b, "%%%02X", r)
+		case windowsSafe && strings.ContainsRune(`<>:"\|?`, r):
+			fmt.Fprintf(&b, "%%%02X", r)
+		case r == '*':
+			// some symbols are allowed in URL paths, but not necessarily in filesystem names
+			// so far I know about one such symbol, asterisk (*), which is not allowed on Windows
+			b.WriteByte('_')
+		case r == '.' && (isFolder || segment == "." || segment == ".."):
+			b.WriteString("%2E")
+		default:
+			b.WriteString(segment[i : i+size])
+		}
+		i += size
+	}
+
+	name := reserveName(b.String())
+	if windowsSafe {
+		name = windowsName(name)
+	}
+
+	return name
+}
+
+// windowsName escapes what Windows would not take in a name
+func windowsName(name string) string {
+	// "CON", "con.html" and "Con .txt" are all the console
+	base, _, _ := strings.Cut(name, ".")
+	if _, ok := windowsDeviceNames[strings.ToUpper(strings.TrimRight(base, " "))]; ok {
+		name = fmt.Sprintf("%%%02X", name[0]) + name[1:]
+	}
+	// trailing dots and spaces are silently dropped
+	if last := name[len(name)-1]; last == '.' || last == ' ' {
+		name = name[:len(name)-1] + fmt.Sprintf("%%%02X", last)
+	}
+
+	return name
+}
+
+// reserveName escapes the names we use ourselves
+func reserveName(name string) string {
+	if name == settings.RootFilename || strings.HasPrefix(name, settings.RootFilename+".") ||
+		strings.HasPrefix(name, settings.RootFilename+"__") {
+		return fmt.Sprintf("%%%02X", name[0]) + name[1:]
+	}
+	if strings.HasSuffix(name, ".temp") {
+		return strings.TrimSuffix(name, ".temp") + "%2Etemp"
+	}
+
+	return name
+}
+
+// shortenComponent cuts a name that is too long, keeping its extension, and
+// adds a hash of the full name to keep it unique
+func shortenComponent(name string) string {
+	if len(name) <= maxComponentLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "~" + hex.EncodeToString(sum[:8])
+	ext := path.Ext(name)
+	if len(ext) > 16 {
+		// that is not an extension, just a dot somewhere
+		ext = ""
+	}
+
+	cut := maxComponentLength - len(suffix) - len(ext)
+	// do not cut a character or our escape in half
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	if i := strings.LastIndexByte(name[:cut], '%'); i >= 0 && i > cut-3 {
+		cut = i
+	}
+
+	return name[:cut] + suffix + ext
+}
+
+// DisambiguateFilename makes a file name unique for a given URL, for the rare
+// case when two URLs still end up with the same name
+func DisambiguateFilename(filename, urlString string) string {
+	sum := sha256.Sum256([]byte(urlString))
+	ext := path.Ext(filename)
+
+	return strings.TrimSuffix(filename, ext) + "~" + hex.EncodeToString(sum[:4]) + ext
+}
@@ -3,14 +3,10 @@ package utils
 import (
 	"fmt"
 	"net/url"
-	"slices"
 	"strings"
 
 	"github.com/PuerkitoBio/purell"
-	"golang.org/x/exp/maps"
 	"golang.org/x/net/idna"
-
-	"github.com/skaurus/ta-site-crawler/internal/settings"
 )
 
 func UrlToHost(urlObject *url.URL) (string, error) {
@@ -60,6 +56,10 @@ func DomainToOutputFolder(urlObject *url.URL) string {
 	}
 
 	subfolder := strings.Join(strings.Split(host, "."), "_")
+	if windowsSafe {
+		// an intranet host can be called "aux"
+		subfolder = windowsName(subfolder)
+	}
 	// theoretically, some crazy person can use http scheme on port 443 AND serve
 	// different content than on port 80. in this case, we will make a mistake of
 	// choosing the same subfolder. but I don't want to be too nitpicky in TA
@@ -70,48 +70,11 @@ func DomainToOutputFolder(urlObject *url.URL) string {
 	return subfolder
 }
 
+// NormalizeUrlObject returns the canonical form of a URL (see canonical.go);
+// everything that is queued, deduplicated and saved goes through it
 func NormalizeUrlObject(urlObject *url.URL) (*url.URL, error) {
+	urlObject, flags := canonicalize(urlObject)
 	// unfortunately, purell lib returns only strings, not an *url.URL
-	normalizedURL := purell.NormalizeURL(urlObject, purell.FlagsSafe)
+	normalizedURL := purell.NormalizeURL(urlObject, flags)
 	return url.Parse(normalizedURL)
 }
-
-// UrlToFileStructure converts URL path to a file path and name
-func UrlToFileStructure(urlObject *url.URL) (path, filename string) {
-	// path could be empty, filename could be empty as well (e.g., https://example.com/
-	// or https://example.com/path/), but we will handle it
-	urlPath := strings.TrimPrefix(strings.TrimSuffix(urlObject.Path, "/"), "/")
-	urlPathElements := strings.Split(urlPath, "/")
-	filename = urlPathElements[len(urlPathElements)-1]
-	if len(filename) == 0 {
-		// we have possible filename collisions here (different documents served
-		// from /, /_index (with, say, content-type text/html), /_index.html).
-		// with the `_index` instead of just `index` it is not so likely though.
-		// also, it is not so obvious how to fix that when we do not yet know
-		// what filenames we actually will receive from the server.
-		// so let's just hope it will be alright and fix it when we actually hit
-		// the problem, instead of creating complexity from the get go.
-		filename = settings.RootFilename
-	}
-	path = strings.Join(urlPathElements[:len(urlPathElements)-1], "/")
-
-	// some symbols are allowed in URL paths, but not necessarily in filesystem names
-	// so far I know about one such symbol, asterisk (*), which is not allowed on Windows
-	path = strings.ReplaceAll(path, "*", "_")
-	filename = strings.ReplaceAll(filename, "*", "_")
-
-	// also, we need to make unique filenames for different sets of GET parameters
-	var params = urlObject.Query()
-	sortedParamNames := maps.Keys(params)
-	slices.Sort(sortedParamNames)
-	paramStrings := make([]string, 0, len(sortedParamNames))
-	for _, paramName := range sortedParamNames {
-		paramValues := params[paramName]
-		paramStrings = append(paramStrings, fmt.Sprintf("%s-%s", paramName, strings.Join(paramValues, "-")))
-	}
-	if len(paramStrings) > 0 {
-		filename = fmt.Sprintf("%s__%s", filename, strings.Join(paramStrings, "_"))
-	}
-
-	return
-}
@@ -0,0 +1,309 @@
+package warc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // sha1 is what everyone uses for WARC digests
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skaurus/ta-site-crawler/internal/settings"
+)
+
+// WARC 1.1 writer, see https://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/
+// every record is a separate gzip member, as is customary for .warc.gz files —
+// that allows tools to seek to a record without decompressing the whole file.
+// files are rotated when they grow over a given size, and every file starts
+// with a warcinfo record describing the crawl.
+
+// Field is a named field of a warcinfo record; those are ordered, so not a map
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Exchange is a request-response pair to be recorded
+type Exchange struct {
+	Request  *http.Request
+	Response *http.Response
+	// body is read by the caller (we need it for other things too), so here
+	// we get it separately from the Response; it is read from the start, and
+	// it can be big, so it is never loaded to memory
+	Body     io.ReadSeeker
+	BodySize int64
+	// the body is cut, because it was too big
+	Truncated bool
+	IPAddress string
+	Date      time.Time
+}
+
+type Writer struct {
+	mu      sync.Mutex
+	dir     string
+	prefix  string
+	maxSize int64
+	info    []Field
+
+	file    *os.File
+	written int64
+	serial  int
+	// all the files of the same run share it
+	startedAt string
+}
+
+// NewWriter creates a writer that puts .warc.gz files into dir; the files are
+// rotated when they become bigger than maxSize bytes
+func NewWriter(dir, prefix string, maxSize int64, info []Field) (*Writer, error) {
+	err := os.MkdirAll(dir, settings.DirPermissions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		dir:       dir,
+		prefix:    prefix,
+		maxSize:   maxSize,
+		info:      info,
+		startedAt: time.Now().UTC().Format("20060102150405"),
+	}, nil
+}
+
+// WriteExchange writes a request record and a response record for it
+func (w *Writer) WriteExchange(exchange Exchange) error {
+	targetURI := exchange.Request.URL.String()
+	responseID := newRecordID()
+
+	var requestBlock bytes.Buffer
+	requestURI := exchange.Request.URL.RequestURI()
+	fmt.Fprintf(&requestBlock, "%s %s HTTP/1.1\r\n", exchange.Request.Method, requestURI)
+	fmt.Fprintf(&requestBlock, "Host: %s\r\n", exchange.Request.URL.Host)
+	_ = exchange.Request.Header.Write(&requestBlock)
+	requestBlock.WriteString("\r\n")
+
+	// we record the response the way net/http gave it to us: with chunked
+	// encoding and compression already undone. so the headers must tell the
+	// truth about the body we actually have
+	header := exchange.Response.Header.Clone()
+	header.Del("Transfer-Encoding")
+	if exchange.Response.Uncompressed {
+		header.Del("Content-Encoding")
+	}
+	header.Set("Content-Length", strconv.FormatInt(exchange.BodySize, 10))
+	var responseHead bytes.Buffer
+	fmt.Fprintf(&responseHead, "HTTP/%d.%d %s\r\n", exchange.Response.ProtoMajor, exchange.Response.ProtoMinor, exchange.Response.Status)
+	_ = header.Write(&responseHead)
+	responseHead.WriteString("\r\n")
+
+	blockDigest, payloadDigest, err := digests(responseHead.Bytes(), exchange.Body)
+	if err != nil {
+		return err
+	}
+
+	date := exchange.Date.UTC().Format(time.RFC3339)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	responseFields := []Field{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", responseID},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", targetURI},
+		{"WARC-Block-Digest", blockDigest},
+		{"WARC-Payload-Digest", payloadDigest},
+	}
+	if len(exchange.IPAddress) > 0 {
+		responseFields = append(responseFields, Field{"WARC-IP-Address", exchange.IPAddress})
+	}
+	if exchange.Truncated {
+		responseFields = append(responseFields, Field{"WARC-Truncated", "length"})
+	}
+	responseFields = append(responseFields, Field{"Content-Type", "application/http;msgtype=response"})
+	err = w.writeRecord(responseFields, responseHead.Bytes(), exchange.Body, exchange.BodySize)
+	if err != nil {
+		return err
+	}
+
+	requestFields := []Field{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", newRecordID()},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", targetURI},
+		{"WARC-Concurrent-To", responseID},
+	}
+	if len(exchange.IPAddress) > 0 {
+		requestFields = append(requestFields, Field{"WARC-IP-Address", exchange.IPAddress})
+	}
+	requestFields = append(requestFields,
+		Field{"WARC-Block-Digest", digest(requestBlock.Bytes())},
+		Field{"Content-Type", "application/http;msgtype=request"},
+	)
+	err = w.writeRecord(requestFields, requestBlock.Bytes(), nil, 0)
+	if err != nil {
+		return err
+	}
+
+	// rotation happens between the exchanges, so the request and the response
+	// always end up in the same file
+	if w.written >= w.maxSize {
+		return w.closeFile()
+	}
+
+	return nil
+}
+
+// Close closes the current file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.closeFile()
+}
+
+func (w *Writer) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file, w.written = nil, 0
+
+	return err
+}
+
+// openFile opens the next file and writes a warcinfo record to it
+func (w *Writer) openFile() error {
+	w.serial++
+	filename := fmt.Sprintf("%s-%s-%05d.warc.gz", w.prefix, w.startedAt, w.serial)
+	file, err := os.OpenFile(filepath.Join(w.dir, filename), os.O_WRONLY|os.O_CREATE|os.O_EXCL, settings.FilePermissions)
+	if err != nil {
+		return err
+	}
+	w.file, w.written = file, 0
+
+	var block bytes.Buffer
+	for _, field := range w.info {
+		fmt.Fprintf(&block, "%s: %s\r\n", field.Name, field.Value)
+	}
+
+	return w.writeRecord([]Field{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", newRecordID()},
+		{"WARC-Date", time.Now().UTC().Format(time.RFC3339)},
+		{"WARC-Filename", filename},
+		{"WARC-Block-Digest", digest(block.Bytes())},
+		{"Content-Type", "application/warc-fields"},
+	}, block.Bytes(), nil, 0)
+}
+
+// writeRecord writes a record as a separate gzip member; the record block is
+// head followed by bodySize bytes of body (if any). Must be called with the
+// mutex held
+func (w *Writer) writeRecord(fields []Field, head []byte, body io.ReadSeeker, bodySize int64) error {
+	if w.file == nil {
+		// openFile calls us back to write warcinfo, and w.file is set by then
+		if err := w.openFile(); err != nil {
+			return err
+		}
+	}
+
+	counter := &countingWriter{w: w.file}
+	gzipWriter := gzip.NewWriter(counter)
+	defer func() {
+		w.written += counter.n
+	}()
+
+	var recordHead bytes.Buffer
+	recordHead.WriteString("WARC/1.1\r\n")
+	for _, field := range fields {
+		fmt.Fprintf(&recordHead, "%s: %s\r\n", field.Name, field.Value)
+	}
+	fmt.Fprintf(&recordHead, "Content-Length: %d\r\n", int64(len(head))+bodySize)
+	recordHead.WriteString("\r\n")
+	recordHead.Write(head)
+	if _, err := gzipWriter.Write(recordHead.Bytes()); err != nil {
+		return err
+	}
+	if body != nil {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(gzipWriter, body, bodySize); err != nil {
+			return err
+		}
+	}
+	if _, err := gzipWriter.Write([]byte("\r\n\r\n")); err != nil {
+		return err
+	}
+
+	return gzipWriter.Close()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func digest(data []byte) string {
+	sum := sha1.Sum(data) //nolint:gosec
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// digests returns the digest of the whole block (head and body), and of the
+// payload (body only), reading the body once
+func digests(head []byte, body io.ReadSeeker) (blockDigest, payloadDigest string, err error) {
+	blockHasher, payloadHasher := sha1.New(), sha1.New() //nolint:gosec
+	blockHasher.Write(head)
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	if _, err := io.Copy(io.MultiWriter(blockHasher, payloadHasher), body); err != nil {
+		return "", "", err
+	}
+
+	encode := func(sum []byte) string {
+		return "sha1:" + base32.StdEncoding.EncodeToString(sum)
+	}
+	return encode(blockHasher.Sum(nil)), encode(payloadHasher.Sum(nil)), nil
+}
+
+// newRecordID returns a random (version 4) UUID URN
+func newRecordID() string {
+	var uuid [16]byte
+	_, _ = rand.Read(uuid[:])
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
+// SettingsFields turns key-value pairs into warcinfo fields, sorted by key
+func SettingsFields(values map[string]string) []Field {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make([]Field, 0, len(keys))
+	for _, key := range keys {
+		fields = append(fields, Field{Name: key, Value: strings.TrimSpace(values[key])})
+	}
+
+	return fields
+}